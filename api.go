@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gomodule/oauth1/oauth"
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+// instapaperAPI makes the Instapaper API calls the archive needs with its
+// own HTTP client. The instapaper package's services always use
+// http.DefaultClient, which would mean replacing it for the whole process to
+// time out and retry API requests. Requests are signed and errors are
+// reported just as the instapaper package does.
+type instapaperAPI struct {
+	Client     *instapaper.Client
+	HTTPClient *http.Client
+}
+
+func (a *instapaperAPI) context() context.Context {
+	return context.WithValue(context.Background(), oauth.HTTPClient, a.HTTPClient)
+}
+
+// Authenticate exchanges the username and password for OAuth credentials.
+func (a *instapaperAPI) Authenticate() error {
+	credentials, _, err := a.Client.OAuthClient.RequestTokenXAuthContext(a.context(), nil, a.Client.Username, a.Client.Password)
+	if err != nil {
+		return err
+	}
+	a.Client.Credentials = credentials
+	return nil
+}
+
+// call posts params to the API's path and returns the body of a successful
+// response.
+func (a *instapaperAPI) call(path string, params url.Values) ([]byte, error) {
+	if a.Client.Credentials == nil {
+		return nil, &instapaper.APIError{
+			Message:   "Please call Authenticate() first",
+			ErrorCode: instapaper.ErrNotAuthenticated,
+		}
+	}
+	res, err := a.Client.OAuthClient.PostContext(a.context(), a.Client.Credentials, a.Client.BaseURL+path, params)
+	if err != nil {
+		return nil, &instapaper.APIError{
+			Message:      err.Error(),
+			ErrorCode:    instapaper.ErrHTTPError,
+			WrappedError: err,
+		}
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &instapaper.APIError{
+			StatusCode:   res.StatusCode,
+			Message:      err.Error(),
+			ErrorCode:    instapaper.ErrHTTPError,
+			WrappedError: err,
+		}
+	}
+	if res.StatusCode == http.StatusOK {
+		return body, nil
+	}
+	var apiErrors []instapaper.APIError
+	if err := json.Unmarshal(body, &apiErrors); err != nil || len(apiErrors) == 0 {
+		return nil, &instapaper.APIError{
+			StatusCode:   res.StatusCode,
+			Message:      fmt.Sprintf("unexpected response: %s", res.Status),
+			ErrorCode:    instapaper.ErrUnmarshalError,
+			WrappedError: err,
+		}
+	}
+	apiErrors[0].StatusCode = res.StatusCode
+	return nil, &apiErrors[0]
+}
+
+// callJSON calls the API and decodes its response into v.
+func (a *instapaperAPI) callJSON(path string, params url.Values, v interface{}) error {
+	body, err := a.call(path, params)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return &instapaper.APIError{
+			StatusCode:   http.StatusOK,
+			Message:      err.Error(),
+			ErrorCode:    instapaper.ErrUnmarshalError,
+			WrappedError: err,
+		}
+	}
+	return nil
+}
+
+// ListFolders returns the user's folders.
+func (a *instapaperAPI) ListFolders() ([]instapaper.Folder, error) {
+	var folders []instapaper.Folder
+	err := a.callJSON("/folders/list", nil, &folders)
+	return folders, err
+}
+
+// ListBookmarks returns up to limit bookmarks in the folder, leaving out
+// the comma-separated IDs in have.
+func (a *instapaperAPI) ListBookmarks(folderID, have string, limit int) (*instapaper.BookmarkListResponse, error) {
+	params := url.Values{}
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("have", have)
+	params.Set("highlights", "")
+	if folderID != "" {
+		params.Set("folder_id", folderID)
+	}
+	var resp instapaper.BookmarkListResponse
+	if err := a.callJSON("/bookmarks/list", params, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetText returns the bookmark's text view HTML.
+func (a *instapaperAPI) GetText(bookmarkID int) (string, error) {
+	params := url.Values{}
+	params.Set("bookmark_id", strconv.Itoa(bookmarkID))
+	body, err := a.call("/bookmarks/get_text", params)
+	return string(body), err
+}
+
+// ListHighlights returns the bookmark's highlights.
+func (a *instapaperAPI) ListHighlights(bookmarkID int) ([]instapaper.Highlight, error) {
+	var highlights []instapaper.Highlight
+	err := a.callJSON(fmt.Sprintf("/bookmarks/%d/highlights", bookmarkID), nil, &highlights)
+	return highlights, err
+}
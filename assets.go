@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// assetsDirName is the directory in the archive which mirrored images are
+// saved to, shared by every bookmark.
+const assetsDirName = "_assets"
+
+// assetIndexFileName records which file each image URL was saved to, so
+// images aren't downloaded again on every run.
+const assetIndexFileName = ".index.json"
+
+// defaultAssetMaxSize is the largest image mirrored by default.
+const defaultAssetMaxSize = 10 << 20
+
+// assetTimeout bounds each image download.
+const assetTimeout = 30 * time.Second
+
+// assetExtensions are the image types which are mirrored, and the extension
+// each is saved with.
+var assetExtensions = map[string]string{
+	"image/avif":    ".avif",
+	"image/gif":     ".gif",
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/svg+xml": ".svg",
+	"image/webp":    ".webp",
+}
+
+// assetMirror downloads the images in bookmarks' full text into the archive,
+// so they can be viewed offline. Images are named after a hash of their
+// contents, so each is only stored once. A nil mirror leaves everything as
+// it is.
+type assetMirror struct {
+	// Directory is the archive directory. Images are saved to its
+	// _assets directory.
+	Directory string
+	Client    *http.Client
+	// MaxSize is the largest image to mirror, in bytes. If zero,
+	// defaultAssetMaxSize is used.
+	MaxSize int64
+
+	mu    sync.Mutex
+	byURL map[string]string
+}
+
+func newAssetMirror(archiveDirectory string) *assetMirror {
+	return &assetMirror{
+		Directory: archiveDirectory,
+		Client:    &http.Client{Timeout: assetTimeout},
+	}
+}
+
+func (m *assetMirror) dir() string {
+	return filepath.Join(m.Directory, assetsDirName)
+}
+
+// Load prepares the assets directory and reads the index of images already
+// mirrored.
+func (m *assetMirror) Load() error {
+	if m == nil {
+		return nil
+	}
+	if err := os.MkdirAll(m.dir(), 0755); err != nil {
+		return err
+	}
+	if err := removeAtomicWriteTempFiles(m.dir()); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.byURL = map[string]string{}
+	indexPath := filepath.Join(m.dir(), assetIndexFileName)
+	if !fileExists(indexPath) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &m.byURL); err != nil {
+		return fmt.Errorf("error reading %s: %v", indexPath, err)
+	}
+	if m.byURL == nil {
+		m.byURL = map[string]string{}
+	}
+	return nil
+}
+
+// Save writes the index of mirrored images.
+func (m *assetMirror) Save() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byURL == nil {
+		// Nothing was loaded, so there's nothing to save.
+		return nil
+	}
+	data, err := json.MarshalIndent(m.byURL, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(m.dir(), assetIndexFileName), data, 0644)
+}
+
+// Mirror downloads the images in fullText, resolving relative URLs against
+// pageURL, and returns the name of the file in _assets each mirrored image
+// was saved to, keyed by its src in fullText. Images which can't be mirrored
+// are left out. The full text itself isn't changed: each output format
+// links to the images relative to its own files, with rewriteAssetLinks.
+func (m *assetMirror) Mirror(ctx context.Context, fullText, pageURL string) (map[string]string, error) {
+	if m == nil || fullText == "" {
+		return nil, nil
+	}
+	base, _ := url.Parse(pageURL)
+	var assets map[string]string
+	_, err := rewriteImages(fullText, func(src string) (string, bool) {
+		if name, ok := assets[src]; ok {
+			return name, true
+		}
+		name, ok := m.mirrorImage(ctx, src, base)
+		if !ok {
+			return "", false
+		}
+		if assets == nil {
+			assets = map[string]string{}
+		}
+		assets[src] = name
+		return name, true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return assets, nil
+}
+
+// mirrorImage downloads the image at src, unless it's been mirrored
+// already, and returns its file name.
+func (m *assetMirror) mirrorImage(ctx context.Context, src string, base *url.URL) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(src))
+	if err != nil {
+		return "", false
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	u.Fragment = ""
+	imageURL := u.String()
+
+	m.mu.Lock()
+	name, ok := m.byURL[imageURL]
+	m.mu.Unlock()
+	if !ok || !fileExists(filepath.Join(m.dir(), name)) {
+		name, err = m.download(ctx, imageURL)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("not mirroring image", "image_url", imageURL, "stage", logStageAssets, "error", err)
+			}
+			return "", false
+		}
+		m.mu.Lock()
+		if m.byURL == nil {
+			m.byURL = map[string]string{}
+		}
+		m.byURL[imageURL] = name
+		m.mu.Unlock()
+	}
+	return name, true
+}
+
+// download saves the image at imageURL and returns its file name.
+func (m *assetMirror) download(ctx context.Context, imageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := m.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", res.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	extension, ok := assetExtensions[mediaType]
+	if !ok {
+		return "", fmt.Errorf("unsupported content type %q", res.Header.Get("Content-Type"))
+	}
+	maxSize := m.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultAssetMaxSize
+	}
+	if res.ContentLength > maxSize {
+		return "", fmt.Errorf("image is %d bytes, more than the limit of %d", res.ContentLength, maxSize)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > maxSize {
+		return "", fmt.Errorf("image is more than the limit of %d bytes", maxSize)
+	}
+
+	hash := sha256.Sum256(data)
+	name := hex.EncodeToString(hash[:16]) + extension
+	path := filepath.Join(m.dir(), name)
+	if fileExists(path) {
+		return name, nil
+	}
+	return name, writeFileAtomic(path, data, 0644)
+}
+
+// rewriteImages calls fn with the src of each image in fullText, and
+// returns fullText with the src of those fn returns true for replaced by
+// what it returns. srcset and sizes are dropped from those images, since
+// they'd still point at the original site.
+func rewriteImages(fullText string, fn func(src string) (string, bool)) (string, error) {
+	var out bytes.Buffer
+	rewritten := false
+	tokenizer := html.NewTokenizer(strings.NewReader(fullText))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if err := tokenizer.Err(); err != io.EOF {
+				return fullText, err
+			}
+			break
+		}
+		raw := tokenizer.Raw()
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			out.Write(raw)
+			continue
+		}
+		// Raw is only valid until the next call to Token.
+		raw = append([]byte(nil), raw...)
+		token := tokenizer.Token()
+		src := ""
+		for _, attr := range token.Attr {
+			if attr.Key == "src" {
+				src = attr.Val
+			}
+		}
+		if token.DataAtom != atom.Img || src == "" {
+			out.Write(raw)
+			continue
+		}
+		newSrc, ok := fn(src)
+		if !ok {
+			out.Write(raw)
+			continue
+		}
+		attrs := token.Attr[:0]
+		for _, attr := range token.Attr {
+			switch attr.Key {
+			case "src":
+				attr.Val = newSrc
+			case "srcset", "sizes":
+				continue
+			}
+			attrs = append(attrs, attr)
+		}
+		token.Attr = attrs
+		out.WriteString(token.String())
+		rewritten = true
+	}
+	if !rewritten {
+		return fullText, nil
+	}
+	return out.String(), nil
+}
+
+// rewriteAssetLinks returns fullText with each image mirrored in assets,
+// keyed by its src, pointing at prefix followed by its file name.
+func rewriteAssetLinks(fullText string, assets map[string]string, prefix string) (string, error) {
+	if len(assets) == 0 {
+		return fullText, nil
+	}
+	return rewriteImages(fullText, func(src string) (string, bool) {
+		name, ok := assets[src]
+		return prefix + name, ok
+	})
+}
+
+// localizeAssets copies the images mirrored for the bookmark from the
+// archive's _assets into dir, unless they're there already, and returns its
+// full text pointing at the copies with prefix. Images missing from _assets
+// keep their original URL.
+func localizeAssets(bookmark bookmarkData, archiveDirectory, dir, prefix string) (string, error) {
+	if len(bookmark.Assets) == 0 {
+		return bookmark.FullText, nil
+	}
+	assets := map[string]string{}
+	for src, name := range bookmark.Assets {
+		source := filepath.Join(archiveDirectory, assetsDirName, name)
+		if !fileExists(source) {
+			continue
+		}
+		assets[src] = name
+		target := filepath.Join(dir, name)
+		if fileExists(target) {
+			continue
+		}
+		data, err := ioutil.ReadFile(source)
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(target, data, 0644); err != nil {
+			return "", err
+		}
+	}
+	return rewriteAssetLinks(bookmark.FullText, assets, prefix)
+}
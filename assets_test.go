@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var assetMirrorTestDir = filepath.Join("tmp", "assetMirror")
+
+func newTestAssetServer(t *testing.T) (*httptest.Server, map[string]int) {
+	png := []byte("\x89PNG\r\n\x1a\nnot really a png")
+	requests := map[string]int{}
+	mux := http.NewServeMux()
+	serve := func(path, contentType string, body []byte) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			requests[r.URL.Path]++
+			w.Header().Set("Content-Type", contentType)
+			_, _ = w.Write(body)
+		})
+	}
+	serve("/images/a.png", "image/png", png)
+	serve("/images/copy-of-a.png", "image/png", png)
+	serve("/images/b.jpg", "image/jpeg; charset=binary", []byte("a jpeg"))
+	serve("/images/huge.png", "image/png", bytes.Repeat([]byte("x"), 2048))
+	serve("/images/page.png", "text/html", []byte("<html>not found</html>"))
+	return httptest.NewServer(mux), requests
+}
+
+func TestAssetMirror_Mirror(t *testing.T) {
+	server, requests := newTestAssetServer(t)
+	defer server.Close()
+	defer cleanupTestTmpDir(assetMirrorTestDir)
+
+	m := newAssetMirror(assetMirrorTestDir)
+	m.MaxSize = 1024
+	if err := m.Load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	fullText := fmt.Sprintf(`<p>Text <img src="%[1]s/images/a.png" srcset="%[1]s/images/a.png 2x" alt="A"></p>
+<img src="/images/copy-of-a.png">
+<img src="b.jpg"/>
+<img src="%[1]s/images/huge.png">
+<img src="%[1]s/images/page.png">
+<img src="%[1]s/images/missing.png">
+<img src="data:image/png;base64,AAAA">`, server.URL)
+	mirrored, err := m.Mirror(context.Background(), fullText, server.URL+"/images/article.html")
+	if err != nil {
+		t.Fatalf("mirror failed: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(assetMirrorTestDir, assetsDirName))
+	if err != nil {
+		t.Fatalf("unable to list assets: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	// The two copies of a.png are stored once.
+	if len(names) != 2 {
+		t.Fatalf("expected a png and a jpeg, got %v", names)
+	}
+	var pngName, jpgName string
+	for _, name := range names {
+		switch filepath.Ext(name) {
+		case ".png":
+			pngName = name
+		case ".jpg":
+			jpgName = name
+		}
+	}
+	if pngName == "" || jpgName == "" {
+		t.Fatalf("expected a png and a jpeg, got %v", names)
+	}
+
+	// Images which can't be mirrored are left out.
+	expected := map[string]string{
+		server.URL + "/images/a.png": pngName,
+		"/images/copy-of-a.png":      pngName,
+		"b.jpg":                      jpgName,
+	}
+	if !reflect.DeepEqual(mirrored, expected) {
+		t.Errorf("expected assets %v, got %v", expected, mirrored)
+	}
+
+	// Images are only downloaded once, even across runs.
+	if err := m.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	m = newAssetMirror(assetMirrorTestDir)
+	m.MaxSize = 1024
+	if err := m.Load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	again, err := m.Mirror(context.Background(), fullText, server.URL+"/images/article.html")
+	if err != nil {
+		t.Fatalf("mirror failed: %v", err)
+	}
+	if !reflect.DeepEqual(again, mirrored) {
+		t.Errorf("expected the same assets when mirroring again, got %v", again)
+	}
+	if requests["/images/a.png"] != 1 || requests["/images/b.jpg"] != 1 {
+		t.Errorf("expected each image to be downloaded once, got %v", requests)
+	}
+}
+
+func TestAssetMirror_MirrorWithoutImages(t *testing.T) {
+	defer cleanupTestTmpDir(assetMirrorTestDir)
+	m := newAssetMirror(assetMirrorTestDir)
+	if err := m.Load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	fullText := "<p>Just <b>text</b> &amp; no images</p>"
+	mirrored, err := m.Mirror(context.Background(), fullText, "https://example.com/")
+	if err != nil {
+		t.Fatalf("mirror failed: %v", err)
+	}
+	if mirrored != nil {
+		t.Fatalf("expected no assets, got %v", mirrored)
+	}
+
+	var nilMirror *assetMirror
+	if mirrored, _ := nilMirror.Mirror(context.Background(), `<img src="https://example.com/a.png">`, ""); mirrored != nil {
+		t.Fatalf("expected a nil mirror to mirror nothing, got %v", mirrored)
+	}
+}
+
+func TestRewriteAssetLinks(t *testing.T) {
+	fullText := `<p>Text <img src="https://example.com/a.png" srcset="https://example.com/a.png 2x" sizes="50vw" alt="A"></p>
+<img src="b.jpg"/>
+<img src="https://example.com/c.png">
+<p>a.png</p>`
+	assets := map[string]string{"https://example.com/a.png": "aaaa.png", "b.jpg": "bbbb.jpg"}
+	rewritten, err := rewriteAssetLinks(fullText, assets, "../images/")
+	if err != nil {
+		t.Fatalf("rewrite failed: %v", err)
+	}
+	expected := `<p>Text <img src="../images/aaaa.png" alt="A"></p>
+<img src="../images/bbbb.jpg"/>
+<img src="https://example.com/c.png">
+<p>a.png</p>`
+	if rewritten != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, rewritten)
+	}
+	if unchanged, _ := rewriteAssetLinks(fullText, nil, "../images/"); unchanged != fullText {
+		t.Errorf("expected text without assets to be unchanged, got %q", unchanged)
+	}
+}
+
+// TestLocalizeAssets_Formats checks each format links to mirrored images
+// from wherever it's written, including a subdirectory of the archive.
+func TestLocalizeAssets_Formats(t *testing.T) {
+	defer cleanupTestTmpDir(assetMirrorTestDir)
+	assetsDir := filepath.Join(assetMirrorTestDir, assetsDirName)
+	if err := os.MkdirAll(assetsDir, 0755); err != nil {
+		t.Fatalf("unable to create %s: %v", assetsDir, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(assetsDir, "aaaa.png"), []byte("a png"), 0644); err != nil {
+		t.Fatalf("unable to write image: %v", err)
+	}
+	src := "https://example.com/a.png"
+	bookmark := newTestBookmark(1234, fmt.Sprintf(`<p>Text</p><img src="%s" alt="A">`, src))
+	bookmark.Assets = map[string]string{src: "aaaa.png", "https://example.com/gone.png": "gone.png"}
+
+	for _, test := range []struct {
+		format string
+		// file links to the image as link, which resolves to image.
+		file, link, image string
+	}{
+		{"markdown", "2010-11-01-1234.md", "](assets/aaaa.png)", "assets/aaaa.png"},
+		{"hugo", "content/bookmarks/2010-11-01-1234/index.md", "](aaaa.png)", "content/bookmarks/2010-11-01-1234/aaaa.png"},
+		{"hugo", "content/bookmarks/2010-11-01-1234/mirror.html", `src="aaaa.png"`, "content/bookmarks/2010-11-01-1234/aaaa.png"},
+		{"html", "bookmarks/2010-11-01-1234.html", `src="../images/aaaa.png"`, "images/aaaa.png"},
+		{"jekyll", "_posts/2010-11-01-1234.html", `src="/assets/mirrored/aaaa.png"`, "assets/mirrored/aaaa.png"},
+		{"jekyll", "_mirror/1234.html", `src="../assets/mirrored/aaaa.png"`, "assets/mirrored/aaaa.png"},
+	} {
+		directory := filepath.Join(assetMirrorTestDir, test.format)
+		w, err := newFormatOutputWriter(test.format, assetMirrorTestDir, directory, outputOptions{}, nil)
+		if err != nil {
+			t.Fatalf("unable to create %s writer: %v", test.format, err)
+		}
+		if err := w.Preflight(); err != nil {
+			t.Fatalf("%s preflight failed: %v", test.format, err)
+		}
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("%s write failed: %v", test.format, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s close failed: %v", test.format, err)
+		}
+		fileContentsMatch(t, filepath.Join(directory, filepath.FromSlash(test.file)), test.link)
+		fileContentsMatch(t, filepath.Join(directory, filepath.FromSlash(test.image)), "a png")
+	}
+
+	// The archive's own copy of the text is left alone.
+	if bookmark.FullText != fmt.Sprintf(`<p>Text</p><img src="%s" alt="A">`, src) {
+		t.Errorf("expected the full text to be unchanged, got %q", bookmark.FullText)
+	}
+}
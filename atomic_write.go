@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// atomicWriteTempPattern names the temporary files which writeFileAtomic
+// renames into place. They start with a dot so Jekyll ignores them.
+const atomicWriteTempPattern = ".tmp-*"
+
+// writeFileAtomic writes data to path such that, even if the process dies
+// part way through, path either has its old contents or all of data.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomicFunc(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFileAtomicFunc calls write with a temporary file in the same
+// directory as path, syncs it to disk, then renames it over path. If write
+// fails, path is left untouched.
+func writeFileAtomicFunc(path string, perm os.FileMode, write func(io.Writer) error) (err error) {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, atomicWriteTempPattern)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	// Sync the directory too so the rename itself survives a crash. Not
+	// every platform supports this, so it's best-effort.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// removeAtomicWriteTempFiles cleans up temporary files left behind in dir by
+// writes which were interrupted.
+func removeAtomicWriteTempFiles(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, atomicWriteTempPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
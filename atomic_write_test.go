@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var atomicWriteTestDir = filepath.Join("tmp", "atomicWrite")
+
+func TestWriteFileAtomic(t *testing.T) {
+	if err := os.MkdirAll(atomicWriteTestDir, 0755); err != nil {
+		t.Fatalf("unable to create dir: %v", err)
+	}
+	defer cleanupTestTmpDir(atomicWriteTestDir)
+	path := filepath.Join(atomicWriteTestDir, "file.txt")
+
+	if err := writeFileAtomic(path, []byte("first"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := writeFileAtomic(path, []byte("second"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, path, "second")
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Fatalf("expected file mode 0644, got %v: %v", info.Mode().Perm(), err)
+	}
+	assertNoAtomicWriteTempFiles(t, atomicWriteTestDir)
+}
+
+func TestWriteFileAtomic_Interrupted(t *testing.T) {
+	if err := os.MkdirAll(atomicWriteTestDir, 0755); err != nil {
+		t.Fatalf("unable to create dir: %v", err)
+	}
+	defer cleanupTestTmpDir(atomicWriteTestDir)
+	path := filepath.Join(atomicWriteTestDir, "file.txt")
+	interrupted := errors.New("interrupted")
+
+	// A failed first write leaves nothing behind.
+	err := writeFileAtomicFunc(path, 0644, func(w io.Writer) error {
+		io.WriteString(w, "half of the")
+		return interrupted
+	})
+	if err != interrupted {
+		t.Fatalf("expected %v, got %v", interrupted, err)
+	}
+	if fileExists(path) {
+		t.Fatalf("expected %q not to exist", path)
+	}
+
+	// A failed rewrite leaves the old contents.
+	if err := writeFileAtomic(path, []byte("complete contents"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = writeFileAtomicFunc(path, 0644, func(w io.Writer) error {
+		io.WriteString(w, "half of the")
+		return interrupted
+	})
+	if err != interrupted {
+		t.Fatalf("expected %v, got %v", interrupted, err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "complete contents" {
+		t.Fatalf("expected old contents to be intact, got %q: %v", data, err)
+	}
+	assertNoAtomicWriteTempFiles(t, atomicWriteTestDir)
+}
+
+func assertNoAtomicWriteTempFiles(t *testing.T, dir string) {
+	paths, err := filepath.Glob(filepath.Join(dir, atomicWriteTempPattern))
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	if len(paths) > 0 {
+		t.Fatalf("expected no temporary files, found %v", paths)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// pageCaptureDirName is the directory in the archive which holds the
+// original pages fetched for bookmarks Instapaper has no text for.
+const pageCaptureDirName = ".pages"
+
+// defaultPageCaptureMaxSize is the largest page captured by default.
+const defaultPageCaptureMaxSize = 5 << 20
+
+// defaultPageCaptureTimeout bounds each page, and each robots.txt, fetched.
+const defaultPageCaptureTimeout = 30 * time.Second
+
+// pageCaptureUserAgent identifies us to sites, and is the name matched
+// against User-agent lines in robots.txt.
+const pageCaptureUserAgent = "instapaper-archive"
+
+// maxRobotsTxtSize is the most of a robots.txt which is read.
+const maxRobotsTxtSize = 512 << 10
+
+// errPageCaptureOptOut is returned for pages whose site asks not to be
+// archived.
+var errPageCaptureOptOut = errors.New("site opts out of archiving")
+
+// pageCapture fetches bookmarks' original pages, keeping the raw response
+// and extracting the article text from it. A nil capture fetches nothing.
+type pageCapture struct {
+	// Directory is the archive directory. Pages are saved to its .pages
+	// directory.
+	Directory string
+	Client    *http.Client
+	// MaxSize is the largest page to capture, in bytes. If zero,
+	// defaultPageCaptureMaxSize is used.
+	MaxSize int64
+
+	mu     sync.Mutex
+	robots map[string]robotsRules
+}
+
+// capturedPage is kept alongside each captured page's HTML, recording
+// where it came from.
+type capturedPage struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+	FetchedAt  time.Time
+}
+
+func newPageCapture(archiveDirectory string, timeout time.Duration) *pageCapture {
+	return &pageCapture{
+		Directory: archiveDirectory,
+		Client:    &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *pageCapture) dir() string {
+	return filepath.Join(c.Directory, pageCaptureDirName)
+}
+
+func (c *pageCapture) Preflight() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir(), 0755); err != nil {
+		return err
+	}
+	return removeAtomicWriteTempFiles(c.dir())
+}
+
+// Capture fetches the bookmark's original page, saves the response, and
+// returns the article extracted from it as HTML.
+func (c *pageCapture) Capture(ctx context.Context, bookmark bookmarkData) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	pageURL, err := url.Parse(bookmark.GetURL())
+	if err != nil {
+		return "", err
+	}
+	if pageURL.Scheme != "http" && pageURL.Scheme != "https" {
+		return "", fmt.Errorf("unsupported URL %q", bookmark.GetURL())
+	}
+	allowed, err := c.allowedByRobots(ctx, pageURL)
+	if err != nil {
+		return "", fmt.Errorf("error fetching robots.txt: %v", err)
+	}
+	if !allowed {
+		return "", errPageCaptureOptOut
+	}
+
+	res, body, err := c.get(ctx, pageURL.String(), c.maxSize())
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", res.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return "", fmt.Errorf("unsupported content type %q", res.Header.Get("Content-Type"))
+	}
+	if robotsDirectivesOptOut(strings.Join(res.Header.Values("X-Robots-Tag"), ",")) {
+		return "", errPageCaptureOptOut
+	}
+
+	utf8Body, err := charset.NewReader(bytes.NewReader(body), res.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
+	doc, err := html.Parse(utf8Body)
+	if err != nil {
+		return "", err
+	}
+	if pageOptsOut(doc) {
+		return "", errPageCaptureOptOut
+	}
+
+	page := capturedPage{
+		URL:        res.Request.URL.String(),
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		FetchedAt:  time.Now().UTC(),
+	}
+	if err := c.save(bookmark.GetID(), page, body); err != nil {
+		return "", err
+	}
+
+	text, err := extractReadableHTML(doc)
+	if err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+func (c *pageCapture) maxSize() int64 {
+	if c.MaxSize > 0 {
+		return c.MaxSize
+	}
+	return defaultPageCaptureMaxSize
+}
+
+// get fetches rawURL, reading at most maxSize bytes of the body.
+func (c *pageCapture) get(ctx context.Context, rawURL string, maxSize int64) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", pageCaptureUserAgent)
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.ContentLength > maxSize {
+		return nil, nil, fmt.Errorf("page is %d bytes, more than the limit of %d", res.ContentLength, maxSize)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, nil, fmt.Errorf("page is more than the limit of %d bytes", maxSize)
+	}
+	return res, body, nil
+}
+
+// save writes the page exactly as it was served to <id>.html, and its
+// headers to <id>.json.
+func (c *pageCapture) save(id string, page capturedPage, body []byte) error {
+	meta, err := json.MarshalIndent(page, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(c.dir(), id+".html"), body, 0644); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.dir(), id+".json"), meta, 0644)
+}
+
+// allowedByRobots checks the site's robots.txt, fetching it the first time
+// the site is seen.
+func (c *pageCapture) allowedByRobots(ctx context.Context, pageURL *url.URL) (bool, error) {
+	site := pageURL.Scheme + "://" + pageURL.Host
+	c.mu.Lock()
+	rules, ok := c.robots[site]
+	c.mu.Unlock()
+	if !ok {
+		res, body, err := c.get(ctx, site+"/robots.txt", maxRobotsTxtSize)
+		switch {
+		case err != nil:
+			return false, err
+		case res.StatusCode >= 500:
+			return false, fmt.Errorf("unexpected status %s", res.Status)
+		case res.StatusCode == http.StatusOK:
+			rules = parseRobotsTxt(bytes.NewReader(body), pageCaptureUserAgent)
+		default:
+			// No robots.txt, so everything is allowed.
+		}
+		c.mu.Lock()
+		if c.robots == nil {
+			c.robots = map[string]robotsRules{}
+		}
+		c.robots[site] = rules
+		c.mu.Unlock()
+	}
+	path := pageURL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if pageURL.RawQuery != "" {
+		path += "?" + pageURL.RawQuery
+	}
+	return rules.Allowed(path), nil
+}
+
+// robotsRule is an Allow or Disallow line from robots.txt.
+type robotsRule struct {
+	Allow   bool
+	Pattern string
+}
+
+// robotsRules are the rules in robots.txt which apply to us.
+type robotsRules []robotsRule
+
+// Allowed follows the most specific rule matching path, preferring Allow
+// when rules are equally specific.
+func (r robotsRules) Allowed(path string) bool {
+	allowed, longest := true, -1
+	for _, rule := range r {
+		if !robotsPatternMatches(rule.Pattern, path) {
+			continue
+		}
+		if len(rule.Pattern) > longest || (len(rule.Pattern) == longest && rule.Allow) {
+			allowed, longest = rule.Allow, len(rule.Pattern)
+		}
+	}
+	return allowed
+}
+
+// robotsPatternMatches matches a path prefix which may contain * wildcards
+// and end with $ to anchor it.
+func robotsPatternMatches(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	matched, _ := regexp.MatchString(expr, path)
+	return matched
+}
+
+// parseRobotsTxt returns the rules for the group naming userAgent, or for
+// * if none does.
+func parseRobotsTxt(r io.Reader, userAgent string) robotsRules {
+	var specific, wildcard robotsRules
+	foundSpecific := false
+	var agents []string
+	inRules := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agent := strings.ToLower(value)
+			agents = append(agents, agent)
+			if agent != "*" && agent != "" && strings.Contains(strings.ToLower(userAgent), agent) {
+				foundSpecific = true
+			}
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				// An empty Disallow allows everything.
+				continue
+			}
+			rule := robotsRule{Allow: key == "allow", Pattern: value}
+			for _, agent := range agents {
+				switch {
+				case agent == "*":
+					wildcard = append(wildcard, rule)
+				case agent != "" && strings.Contains(strings.ToLower(userAgent), agent):
+					specific = append(specific, rule)
+				}
+			}
+		}
+	}
+	if foundSpecific {
+		return specific
+	}
+	return wildcard
+}
+
+// robotsDirectivesOptOut reports whether an X-Robots-Tag header or robots
+// meta tag asks for the page not to be archived.
+func robotsDirectivesOptOut(directives string) bool {
+	for _, directive := range strings.Split(directives, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "noarchive", "none":
+			return true
+		}
+	}
+	return false
+}
+
+func pageOptsOut(n *html.Node) bool {
+	if n.Type == html.ElementNode && n.DataAtom == atom.Meta {
+		name := strings.ToLower(markdownAttr(n, "name"))
+		if (name == "robots" || name == pageCaptureUserAgent) && robotsDirectivesOptOut(markdownAttr(n, "content")) {
+			return true
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if pageOptsOut(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// readableStripped are elements which are never part of an article.
+var readableStripped = map[atom.Atom]bool{
+	atom.Aside:    true,
+	atom.Button:   true,
+	atom.Embed:    true,
+	atom.Footer:   true,
+	atom.Form:     true,
+	atom.Header:   true,
+	atom.Iframe:   true,
+	atom.Input:    true,
+	atom.Nav:      true,
+	atom.Noscript: true,
+	atom.Object:   true,
+	atom.Script:   true,
+	atom.Select:   true,
+	atom.Style:    true,
+	atom.Svg:      true,
+	atom.Template: true,
+	atom.Textarea: true,
+}
+
+var (
+	readableUnlikely = regexp.MustCompile(`(?i)comment|sidebar|footer|masthead|menu|nav|share|social|advert|promo|related|cookie|banner|popup|subscribe|newsletter`)
+	readableLikely   = regexp.MustCompile(`(?i)article|content|main|body|post|entry|story|text`)
+)
+
+// extractReadableHTML finds the element containing most of the page's
+// prose, after removing navigation, scripts and the like, and renders it.
+// Paragraphs score their parent, and half as much their grandparent, by how
+// long they are and how many commas they have, discounted by how much of
+// their text is links.
+func extractReadableHTML(doc *html.Node) (string, error) {
+	removeUnreadable(doc)
+
+	scores := map[*html.Node]float64{}
+	var candidates []*html.Node
+	var score func(n *html.Node)
+	score = func(n *html.Node) {
+		if n.Type == html.ElementNode && (n.DataAtom == atom.P || n.DataAtom == atom.Pre || n.DataAtom == atom.Td || n.DataAtom == atom.Blockquote) && n.Parent != nil {
+			text := strings.TrimSpace(markdownText(n))
+			if len(text) >= 25 {
+				points := 1 + float64(strings.Count(text, ","))
+				if extra := float64(len(text) / 100); extra < 3 {
+					points += extra
+				} else {
+					points += 3
+				}
+				for i, ancestor := range []*html.Node{n.Parent, n.Parent.Parent} {
+					if ancestor == nil || ancestor.Type != html.ElementNode {
+						continue
+					}
+					if _, ok := scores[ancestor]; !ok {
+						candidates = append(candidates, ancestor)
+					}
+					scores[ancestor] += points / float64(i+1)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			score(c)
+		}
+	}
+	score(doc)
+
+	var best *html.Node
+	bestScore := 0.0
+	for _, candidate := range candidates {
+		s := scores[candidate] * (1 - linkDensity(candidate))
+		if best == nil || s > bestScore {
+			best, bestScore = candidate, s
+		}
+	}
+	if best == nil {
+		best = findElement(doc, atom.Body)
+	}
+	if best == nil || strings.TrimSpace(markdownText(best)) == "" {
+		return "", errors.New("no readable text in page")
+	}
+
+	var buf bytes.Buffer
+	if best.DataAtom == atom.Body {
+		for c := best.FirstChild; c != nil; c = c.NextSibling {
+			if err := html.Render(&buf, c); err != nil {
+				return "", err
+			}
+		}
+	} else if err := html.Render(&buf, best); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// removeUnreadable removes elements which are never, or are unlikely to be,
+// part of the article.
+func removeUnreadable(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode || (c.Type == html.ElementNode && readableStripped[c.DataAtom]) {
+			n.RemoveChild(c)
+		} else if c.Type == html.ElementNode && c.DataAtom != atom.Html && c.DataAtom != atom.Body && c.DataAtom != atom.Article {
+			classAndID := markdownAttr(c, "class") + " " + markdownAttr(c, "id")
+			if readableUnlikely.MatchString(classAndID) && !readableLikely.MatchString(classAndID) {
+				n.RemoveChild(c)
+			} else {
+				removeUnreadable(c)
+			}
+		} else {
+			removeUnreadable(c)
+		}
+		c = next
+	}
+}
+
+// linkDensity is the proportion of n's text which is in links.
+func linkDensity(n *html.Node) float64 {
+	total := len(strings.TrimSpace(markdownText(n)))
+	if total == 0 {
+		return 0
+	}
+	linked := 0
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			linked += len(strings.TrimSpace(markdownText(n)))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return float64(linked) / float64(total)
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
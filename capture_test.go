@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var pageCaptureTestDir = filepath.Join("tmp", "pageCapture")
+
+const testArticlePage = `<!DOCTYPE html>
+<html><head><title>An article</title><script>tracking()</script></head>
+<body>
+<header><a href="/">Home</a></header>
+<nav><a href="/a">A</a> <a href="/b">B</a></nav>
+<div class="layout">
+  <div id="sidebar-comments"><p>A comment which is long enough to count as a paragraph, surely.</p></div>
+  <div class="post-body">
+    <h1>The heading</h1>
+    <p>The first paragraph of the article, which goes on for a while, and has commas, several of them.</p>
+    <p>The second paragraph of the article, which also goes on for long enough to be counted.</p>
+    <script>more.tracking()</script>
+  </div>
+</div>
+<footer>Copyright</footer>
+</body></html>`
+
+// testPageRequests counts the requests for each path, which the server may
+// handle concurrently.
+type testPageRequests struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (r *testPageRequests) add(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[path]++
+}
+
+// Count returns the number of requests for path so far.
+func (r *testPageRequests) Count(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[path]
+}
+
+func newTestPageServer(t *testing.T) (*httptest.Server, *testPageRequests) {
+	requests := &testPageRequests{counts: map[string]int{}}
+	mux := http.NewServeMux()
+	page := func(path string, fn func(w http.ResponseWriter)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			requests.add(r.URL.Path)
+			if ua := r.Header.Get("User-Agent"); ua != pageCaptureUserAgent {
+				t.Errorf("unexpected user agent %q", ua)
+			}
+			fn(w)
+		})
+	}
+	page("/robots.txt", func(w http.ResponseWriter) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+	})
+	page("/article", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Served-By", "test")
+		fmt.Fprint(w, testArticlePage)
+	})
+	page("/private/article", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, testArticlePage)
+	})
+	page("/noarchive-header", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Robots-Tag", "noindex, noarchive")
+		fmt.Fprint(w, testArticlePage)
+	})
+	page("/noarchive-meta", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, strings.Replace(testArticlePage, "<head>", `<head><meta name="robots" content="noarchive">`, 1))
+	})
+	page("/huge", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, testArticlePage+strings.Repeat(" ", 4096))
+	})
+	page("/slow", func(w http.ResponseWriter) {
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, testArticlePage)
+	})
+	page("/image", func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "not a page")
+	})
+	return httptest.NewServer(mux), requests
+}
+
+func newTestPageCapture(t *testing.T) *pageCapture {
+	c := newPageCapture(pageCaptureTestDir, 100*time.Millisecond)
+	c.MaxSize = 4096
+	if err := c.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	return c
+}
+
+func TestPageCapture_Capture(t *testing.T) {
+	server, requests := newTestPageServer(t)
+	defer server.Close()
+	defer cleanupTestTmpDir(pageCaptureTestDir)
+
+	c := newTestPageCapture(t)
+	bookmark := bookmarkData{BookmarkExportMeta: &bookmarkExportMeta{URL: server.URL + "/article"}}
+	text, err := c.Capture(context.Background(), bookmark)
+	if err != nil {
+		t.Fatalf("capture failed: %v", err)
+	}
+	for _, expected := range []string{`<div class="post-body">`, "<h1>The heading</h1>", "The first paragraph", "The second paragraph"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected text to contain %q:\n\n%s", expected, text)
+		}
+	}
+	for _, unexpected := range []string{"tracking", "Home", "comment", "Copyright"} {
+		if strings.Contains(text, unexpected) {
+			t.Errorf("expected text not to contain %q:\n\n%s", unexpected, text)
+		}
+	}
+
+	// The response is kept as it was served.
+	id := bookmark.GetID()
+	raw, err := ioutil.ReadFile(filepath.Join(pageCaptureTestDir, pageCaptureDirName, id+".html"))
+	if err != nil {
+		t.Fatalf("unable to read captured page: %v", err)
+	}
+	if string(raw) != testArticlePage {
+		t.Errorf("expected the captured page to be the original, got:\n\n%s", raw)
+	}
+	metaPath := filepath.Join(pageCaptureTestDir, pageCaptureDirName, id+".json")
+	fileContentsMatch(t, metaPath, `"URL": "`+server.URL+`/article"`)
+	fileContentsMatch(t, metaPath, `"StatusCode": 200`)
+	fileContentsMatch(t, metaPath, `"X-Served-By": [`)
+
+	// robots.txt is only fetched once per site.
+	if _, err := c.Capture(context.Background(), bookmark); err != nil {
+		t.Fatalf("capture failed: %v", err)
+	}
+	if requests.Count("/robots.txt") != 1 {
+		t.Errorf("expected robots.txt to be fetched once, got %d", requests.Count("/robots.txt"))
+	}
+}
+
+func TestPageCapture_CaptureFailures(t *testing.T) {
+	server, requests := newTestPageServer(t)
+	defer server.Close()
+	defer cleanupTestTmpDir(pageCaptureTestDir)
+
+	c := newTestPageCapture(t)
+	for _, test := range []struct {
+		path   string
+		optOut bool
+	}{
+		{path: "/private/article", optOut: true},
+		{path: "/noarchive-header", optOut: true},
+		{path: "/noarchive-meta", optOut: true},
+		{path: "/huge"},
+		{path: "/slow"},
+		{path: "/image"},
+		{path: "/missing"},
+	} {
+		bookmark := bookmarkData{BookmarkExportMeta: &bookmarkExportMeta{URL: server.URL + test.path}}
+		_, err := c.Capture(context.Background(), bookmark)
+		if err == nil {
+			t.Errorf("expected capturing %s to fail", test.path)
+			continue
+		}
+		if optOut := errors.Is(err, errPageCaptureOptOut); optOut != test.optOut {
+			t.Errorf("expected capturing %s to opt out: %v, got %v", test.path, test.optOut, err)
+		}
+		if fileExists(filepath.Join(pageCaptureTestDir, pageCaptureDirName, bookmark.GetID()+".html")) {
+			t.Errorf("expected %s not to be saved", test.path)
+		}
+	}
+	if requests.Count("/private/article") != 0 {
+		t.Errorf("expected pages disallowed by robots.txt not to be fetched")
+	}
+}
+
+func TestParseRobotsTxt(t *testing.T) {
+	robotsTxt := `# Comments are ignored
+User-agent: *
+Disallow: /
+
+User-agent: OtherBot
+User-agent: Instapaper-Archive
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow:
+`
+	rules := parseRobotsTxt(strings.NewReader(robotsTxt), pageCaptureUserAgent)
+	for path, allowed := range map[string]bool{
+		"/":                     true,
+		"/article":              true,
+		"/private":              false,
+		"/private/article":      false,
+		"/private/public/page":  true,
+		"/papers/paper.pdf":     false,
+		"/papers/paper.pdf?x=1": true,
+	} {
+		if got := rules.Allowed(path); got != allowed {
+			t.Errorf("expected %s to be allowed: %v, got %v", path, allowed, got)
+		}
+	}
+
+	// Without a group for us, the wildcard group applies.
+	rules = parseRobotsTxt(strings.NewReader(robotsTxt), "some-other-archiver")
+	if rules.Allowed("/article") {
+		t.Errorf("expected the wildcard group to disallow everything")
+	}
+}
+
+func TestInstapaperBookmarkDownloadJob_CapturesOriginalPage(t *testing.T) {
+	server, requests := newTestPageServer(t)
+	defer server.Close()
+	defer cleanupTestTmpDir(pageCaptureTestDir)
+
+	store := newBookmarkStore(pageCaptureTestDir)
+	if err := store.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	newJob := func() *InstapaperBookmarkDownloadJob {
+		return &InstapaperBookmarkDownloadJob{
+			BookmarkData: &bookmarkData{BookmarkExportMeta: &bookmarkExportMeta{
+				URL:       server.URL + "/article",
+				Title:     "From the CSV",
+				Timestamp: "1288608076",
+			}},
+			Directory:    pageCaptureTestDir,
+			OutputWriter: jekyllOutputWriter{Directory: pageCaptureTestDir},
+			Store:        store,
+			Capture:      newTestPageCapture(t),
+		}
+	}
+	job := newJob()
+	if err := job.OutputWriter.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	if err := job.Process(context.Background()); err != nil {
+		t.Fatalf("expected job to succeed, got %v", err)
+	}
+	if job.BookmarkData.TextSource != textSourceOriginal {
+		t.Fatalf("expected text to come from the original page, got %q", job.BookmarkData.TextSource)
+	}
+	id := job.BookmarkData.GetID()
+	fileContentsMatch(t, filepath.Join(pageCaptureTestDir, "_mirror", id+".html"), "The first paragraph")
+	fileContentsMatch(t, filepath.Join(pageCaptureTestDir, "_data", id+".json"), `"TextSource": "original"`)
+	fileContentsMatch(t, filepath.Join(pageCaptureTestDir, "_posts", "2010-11-01-"+id+".html"), "text_source: original\n")
+
+	// Once there's text, the page isn't fetched again.
+	if err := newJob().Process(context.Background()); err != nil {
+		t.Fatalf("expected job to succeed, got %v", err)
+	}
+	if requests.Count("/article") != 1 {
+		t.Fatalf("expected the page to be fetched once, got %d", requests.Count("/article"))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// csvExportColumns maps the (lowercased) headers of an Instapaper CSV export
+// to the field they fill in. Unknown columns are ignored and missing ones are
+// left empty, except URL which is required.
+var csvExportColumns = map[string]func(meta *bookmarkExportMeta, value string){
+	"url":       func(meta *bookmarkExportMeta, value string) { meta.URL = value },
+	"title":     func(meta *bookmarkExportMeta, value string) { meta.Title = value },
+	"selection": func(meta *bookmarkExportMeta, value string) { meta.Selection = value },
+	"folder":    func(meta *bookmarkExportMeta, value string) { meta.Folder = value },
+	"timestamp": func(meta *bookmarkExportMeta, value string) { meta.Timestamp = value },
+	"tags":      func(meta *bookmarkExportMeta, value string) { meta.Tags = parseCSVExportTags(value) },
+}
+
+func readBookmarksFromCSVExport(exportCSVFileName string) (map[string]*bookmarkData, error) {
+	csvFile, err := os.Open(exportCSVFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer csvFile.Close()
+
+	bookmarks := map[string]*bookmarkData{}
+	err = readCSVExport(csvFile, func(meta *bookmarkExportMeta) {
+		bookmarks[meta.URL] = &bookmarkData{
+			BookmarkExportMeta: meta,
+			ContainingFolder:   meta.Folder,
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", exportCSVFileName, err)
+	}
+	return bookmarks, nil
+}
+
+// readCSVExport calls fn with each bookmark in an Instapaper CSV export, in
+// order. Columns are found by their header, so they can be in any order.
+// Rows without a URL, or which can't be parsed, are logged and skipped.
+func readCSVExport(r io.Reader, fn func(meta *bookmarkExportMeta)) error {
+	reader := csv.NewReader(r)
+	// Rows are allowed to be short or long; missing fields are empty.
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return errors.New("export is empty")
+	}
+	if err != nil {
+		return err
+	}
+	setters := make([]func(*bookmarkExportMeta, string), len(header))
+	urlColumn := -1
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		setters[i] = csvExportColumns[name]
+		if name == "url" && urlColumn < 0 {
+			urlColumn = i
+		}
+	}
+	if urlColumn < 0 {
+		return fmt.Errorf("no URL column in header %q", strings.Join(header, ","))
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			slog.Warn("skipping malformed CSV export row", "line", parseErr.StartLine, "error", parseErr.Err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		if urlColumn >= len(row) || strings.TrimSpace(row[urlColumn]) == "" {
+			slog.Warn("skipping CSV export row without a URL", "line", line)
+			continue
+		}
+		meta := &bookmarkExportMeta{}
+		for i, value := range row {
+			if i < len(setters) && setters[i] != nil {
+				setters[i](meta, value)
+			}
+		}
+		meta.URL = strings.TrimSpace(meta.URL)
+		if meta.Timestamp != "" {
+			if _, err := strconv.ParseInt(meta.Timestamp, 10, 64); err != nil {
+				slog.Warn("invalid timestamp in CSV export", "line", line, "url", meta.URL, "timestamp", meta.Timestamp)
+			}
+		}
+		fn(meta)
+	}
+}
+
+// parseCSVExportTags parses the Tags column, which Instapaper writes as a
+// JSON array, falling back to a comma-separated list.
+func parseCSVExportTags(value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	var tags []string
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &tags); err == nil {
+			if len(tags) == 0 {
+				return nil
+			}
+			return tags
+		}
+		value = strings.Trim(value, "[]")
+	}
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.Trim(strings.TrimSpace(tag), `"`); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
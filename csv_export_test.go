@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readTestCSVExport(t *testing.T, export string) ([]*bookmarkExportMeta, error) {
+	t.Helper()
+	var metas []*bookmarkExportMeta
+	err := readCSVExport(strings.NewReader(export), func(meta *bookmarkExportMeta) {
+		metas = append(metas, meta)
+	})
+	return metas, err
+}
+
+func TestReadCSVExportMapsColumnsByHeader(t *testing.T) {
+	export := "\ufeffTitle,URL,Folder,Timestamp,Selection,Tags,Extra\n" +
+		"First,https://example.com/1,Unread,1288608076,,\"[\"\"go\"\", \"\"web\"\"]\",x\n" +
+		"Second,https://example.com/2,Archive,1288608077,A quote,[],y\n"
+	metas, err := readTestCSVExport(t, export)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*bookmarkExportMeta{
+		{URL: "https://example.com/1", Title: "First", Folder: "Unread", Timestamp: "1288608076", Tags: []string{"go", "web"}},
+		{URL: "https://example.com/2", Title: "Second", Folder: "Archive", Timestamp: "1288608077", Selection: "A quote"},
+	}
+	if !reflect.DeepEqual(metas, expected) {
+		t.Errorf("expected %+v, got %+v", expected, metas)
+	}
+}
+
+func TestReadCSVExportReadsEveryRow(t *testing.T) {
+	export := "URL,Title,Selection,Folder,Timestamp\n" +
+		"https://example.com/1,One,,Unread,1\n" +
+		"https://example.com/2,Two,,Unread,2\n" +
+		"https://example.com/3,Three,,Unread,3\n"
+	metas, err := readTestCSVExport(t, export)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(metas) != 3 {
+		t.Fatalf("expected 3 bookmarks, got %d", len(metas))
+	}
+	if metas[0].URL != "https://example.com/1" || metas[2].URL != "https://example.com/3" {
+		t.Errorf("expected the first and last rows to be read, got %q and %q", metas[0].URL, metas[2].URL)
+	}
+}
+
+func TestReadCSVExportToleratesShortRows(t *testing.T) {
+	export := "URL,Title,Selection,Folder,Timestamp\n" +
+		"https://example.com/1,Only a title\n" +
+		",No URL,,Unread,1\n" +
+		"https://example.com/2\n"
+	metas, err := readTestCSVExport(t, export)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*bookmarkExportMeta{
+		{URL: "https://example.com/1", Title: "Only a title"},
+		{URL: "https://example.com/2"},
+	}
+	if !reflect.DeepEqual(metas, expected) {
+		t.Errorf("expected %+v, got %+v", expected, metas)
+	}
+}
+
+func TestReadCSVExportSkipsMalformedRows(t *testing.T) {
+	export := "URL,Title\n" +
+		"https://example.com/1,One\n" +
+		"https://example.com/2,A \"bare\" quote\n" +
+		"https://example.com/3,Three\n"
+	metas, err := readTestCSVExport(t, export)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*bookmarkExportMeta{
+		{URL: "https://example.com/1", Title: "One"},
+		{URL: "https://example.com/3", Title: "Three"},
+	}
+	if !reflect.DeepEqual(metas, expected) {
+		t.Errorf("expected %+v, got %+v", expected, metas)
+	}
+}
+
+func TestReadCSVExportRequiresURLColumn(t *testing.T) {
+	if _, err := readTestCSVExport(t, "Title,Folder\nOne,Unread\n"); err == nil {
+		t.Error("expected an error for an export without a URL column")
+	}
+}
+
+func TestParseCSVExportTags(t *testing.T) {
+	tests := map[string][]string{
+		"":             nil,
+		"[]":           nil,
+		`["a", "b c"]`: {"a", "b c"},
+		"a, b":         {"a", "b"},
+		`[a, "b"]`:     {"a", "b"},
+	}
+	for input, expected := range tests {
+		if actual := parseCSVExportTags(input); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("parseCSVExportTags(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
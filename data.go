@@ -15,14 +15,42 @@ type bookmarkData struct {
 	Highlights         []instapaper.Highlight `json:"-"`
 	FullText           string                 `json:"-"`
 	ContainingFolder   string
+	// FetchErrors records why the full text or highlights could never be
+	// fetched, keyed by fetchStageText or fetchStageHighlights.
+	FetchErrors map[string]string `json:",omitempty"`
+	// TextSource records where FullText came from: textSourceInstapaper or
+	// textSourceOriginal.
+	TextSource string `json:",omitempty"`
+	// TextFetched and HighlightsFetched record whether FullText and
+	// Highlights are what the bookmark has now. If not, they're empty
+	// because fetching them failed, and what was archived before is kept.
+	TextFetched       bool `json:"-"`
+	HighlightsFetched bool `json:"-"`
+	// Assets maps the src of each image in FullText mirrored with
+	// -mirror-assets to the name of its file in _assets.
+	Assets map[string]string `json:"-"`
 }
 
+const (
+	fetchStageText       = "text"
+	fetchStageHighlights = "highlights"
+	fetchStageOriginal   = "original"
+)
+
+const (
+	// textSourceInstapaper is text from Instapaper's text view.
+	textSourceInstapaper = "instapaper"
+	// textSourceOriginal is text extracted from the original page.
+	textSourceOriginal = "original"
+)
+
 type bookmarkExportMeta struct {
 	URL       string
 	Title     string
 	Selection string
 	Folder    string
 	Timestamp string
+	Tags      []string `json:",omitempty"`
 	Hash      string
 }
 
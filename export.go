@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Formats of Instapaper export, for -export-format.
+const (
+	exportFormatAuto = "auto"
+	exportFormatCSV  = "csv"
+	exportFormatHTML = "html"
+)
+
+// readBookmarksFromExport reads an Instapaper export in the given format.
+// exportFormatAuto looks at the start of the file to tell HTML from CSV.
+func readBookmarksFromExport(exportFileName, format string) (map[string]*bookmarkData, error) {
+	if format == exportFormatAuto {
+		detected, err := detectExportFormat(exportFileName)
+		if err != nil {
+			return nil, err
+		}
+		format = detected
+	}
+	switch format {
+	case exportFormatCSV:
+		return readBookmarksFromCSVExport(exportFileName)
+	case exportFormatHTML:
+		return readBookmarksFromHTMLExport(exportFileName)
+	default:
+		return nil, fmt.Errorf("unsupported export format: %q", format)
+	}
+}
+
+func detectExportFormat(exportFileName string) (string, error) {
+	f, err := os.Open(exportFileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	start, err := bufio.NewReader(f).Peek(512)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	start = bytes.TrimLeft(bytes.TrimPrefix(start, []byte("\ufeff")), " \t\r\n")
+	if bytes.HasPrefix(start, []byte("<")) {
+		return exportFormatHTML, nil
+	}
+	return exportFormatCSV, nil
+}
+
+// readBookmarksFromExports reads and merges several Instapaper exports.
+// Where exports disagree about a URL, the newest export wins: the one with
+// the most recently saved bookmark, or the later one given if that's a tie.
+func readBookmarksFromExports(exportFileNames []string, format string) (map[string]*bookmarkData, error) {
+	type export struct {
+		bookmarks map[string]*bookmarkData
+		newest    int64
+	}
+	exports := make([]export, 0, len(exportFileNames))
+	for _, exportFileName := range exportFileNames {
+		bookmarks, err := readBookmarksFromExport(exportFileName, format)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("read export", "file", exportFileName, "count", len(bookmarks))
+		exports = append(exports, export{bookmarks: bookmarks, newest: newestExportTimestamp(bookmarks)})
+	}
+	sort.SliceStable(exports, func(i, j int) bool {
+		return exports[i].newest < exports[j].newest
+	})
+	merged := map[string]*bookmarkData{}
+	for _, export := range exports {
+		for url, bookmark := range export.bookmarks {
+			merged[url] = bookmark
+		}
+	}
+	return merged, nil
+}
+
+func newestExportTimestamp(bookmarks map[string]*bookmarkData) int64 {
+	var newest int64
+	for _, bookmark := range bookmarks {
+		if bookmark.BookmarkExportMeta == nil {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(bookmark.BookmarkExportMeta.Timestamp, 10, 64)
+		if err == nil && timestamp > newest {
+			newest = timestamp
+		}
+	}
+	return newest
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadBookmarksFromExportsNewestWins(t *testing.T) {
+	dir := filepath.Join("tmp", "exports")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTestTmpDir(dir)
+
+	newer := filepath.Join(dir, "2021.csv")
+	older := filepath.Join(dir, "2019.csv")
+	exports := map[string]string{
+		newer: "URL,Title,Selection,Folder,Timestamp\n" +
+			"https://example.com/1,One,,Archive,1500000000\n" +
+			"https://example.com/3,Three,,Unread,1600000000\n",
+		older: "URL,Title,Selection,Folder,Timestamp\n" +
+			"https://example.com/1,One,,Unread,1500000000\n" +
+			"https://example.com/2,Two,,Unread,1510000000\n",
+	}
+	for path, export := range exports {
+		if err := ioutil.WriteFile(path, []byte(export), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Given newest first, so command-line order doesn't decide.
+	bookmarks, err := readBookmarksFromExports([]string{newer, older}, exportFormatAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(bookmarks) != 3 {
+		t.Fatalf("expected 3 bookmarks, got %d", len(bookmarks))
+	}
+	if folder := bookmarks["https://example.com/1"].ContainingFolder; folder != "Archive" {
+		t.Errorf("expected the newest export's folder, Archive, got %q", folder)
+	}
+}
+
+func TestReadBookmarksFromExportsNone(t *testing.T) {
+	bookmarks, err := readBookmarksFromExports(nil, exportFormatAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(bookmarks) != 0 {
+		t.Errorf("expected no bookmarks, got %d", len(bookmarks))
+	}
+}
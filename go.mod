@@ -1,8 +1,26 @@
 module github.com/parkr/instapaper-archive
 
-go 1.16
+go 1.26.0
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/gomodule/oauth1 v0.2.0
 	github.com/ochronus/instapaper-go-client v1.0.1-0.20210326052024-1eed9710be3a
+	golang.org/x/net v0.57.0
+	golang.org/x/time v0.16.0
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.60.1
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.24 // indirect
+	github.com/ncruces/go-strftime v1.0.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	modernc.org/libc v1.77.1 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.12.1 // indirect
 )
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func readBookmarksFromHTMLExport(exportHTMLFileName string) (map[string]*bookmarkData, error) {
+	htmlFile, err := os.Open(exportHTMLFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer htmlFile.Close()
+
+	bookmarks := map[string]*bookmarkData{}
+	err = readHTMLExport(htmlFile, func(meta *bookmarkExportMeta) {
+		bookmarks[meta.URL] = &bookmarkData{
+			BookmarkExportMeta: meta,
+			ContainingFolder:   meta.Folder,
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", exportHTMLFileName, err)
+	}
+	return bookmarks, nil
+}
+
+// readHTMLExport calls fn with each bookmark in an Instapaper HTML export, in
+// order. The export lists each folder as a heading followed by its links.
+func readHTMLExport(r io.Reader, fn func(meta *bookmarkExportMeta)) error {
+	tokenizer := html.NewTokenizer(r)
+	var folder strings.Builder
+	inHeading := false
+	var link *bookmarkExportMeta
+	var title strings.Builder
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return err
+			}
+			return nil
+		case html.StartTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.H1, atom.H2, atom.H3:
+				inHeading = true
+				folder.Reset()
+			case atom.A:
+				link = &bookmarkExportMeta{Folder: strings.TrimSpace(folder.String())}
+				title.Reset()
+				for _, attr := range token.Attr {
+					switch strings.ToLower(attr.Key) {
+					case "href":
+						link.URL = strings.TrimSpace(attr.Val)
+					case "time_added", "add_date":
+						link.Timestamp = strings.TrimSpace(attr.Val)
+					case "tags":
+						link.Tags = parseCSVExportTags(attr.Val)
+					}
+				}
+			}
+		case html.EndTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.H1, atom.H2, atom.H3:
+				inHeading = false
+			case atom.A:
+				if link == nil {
+					continue
+				}
+				link.Title = strings.Join(strings.Fields(title.String()), " ")
+				if link.URL == "" {
+					slog.Warn("skipping HTML export link without a URL", "title", link.Title)
+				} else {
+					fn(link)
+				}
+				link = nil
+			}
+		case html.TextToken:
+			switch {
+			case link != nil:
+				title.Write(tokenizer.Text())
+			case inHeading:
+				folder.Write(tokenizer.Text())
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testHTMLExport = `<!DOCTYPE html>
+<html>
+<head><title>Instapaper: Export</title></head>
+<body>
+<h1>Unread</h1>
+<ol>
+<li><a href="https://example.com/1" time_added="1288608076">First
+  bookmark</a></li>
+<li><a href="https://example.com/2">Second &amp; last</a></li>
+</ol>
+<h1>Go Links</h1>
+<ol>
+<li><a href="https://example.com/3" tags="go,web">Third</a></li>
+<li><a>No URL</a></li>
+</ol>
+</body>
+</html>
+`
+
+func TestReadHTMLExport(t *testing.T) {
+	var metas []*bookmarkExportMeta
+	err := readHTMLExport(strings.NewReader(testHTMLExport), func(meta *bookmarkExportMeta) {
+		metas = append(metas, meta)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*bookmarkExportMeta{
+		{URL: "https://example.com/1", Title: "First bookmark", Folder: "Unread", Timestamp: "1288608076"},
+		{URL: "https://example.com/2", Title: "Second & last", Folder: "Unread"},
+		{URL: "https://example.com/3", Title: "Third", Folder: "Go Links", Tags: []string{"go", "web"}},
+	}
+	if !reflect.DeepEqual(metas, expected) {
+		t.Errorf("expected %+v, got %+v", expected, metas)
+	}
+}
+
+func TestReadBookmarksFromExportDetectsFormat(t *testing.T) {
+	dir := filepath.Join("tmp", "export_format")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTestTmpDir(dir)
+
+	htmlPath := filepath.Join(dir, "export.html")
+	csvPath := filepath.Join(dir, "export.csv")
+	if err := ioutil.WriteFile(htmlPath, []byte("\n"+testHTMLExport), 0644); err != nil {
+		t.Fatal(err)
+	}
+	csvExport := "URL,Title,Selection,Folder,Timestamp\nhttps://example.com/1,First,,Unread,1288608076\n"
+	if err := ioutil.WriteFile(csvPath, []byte(csvExport), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expectedCount := range map[string]int{htmlPath: 3, csvPath: 1} {
+		bookmarks, err := readBookmarksFromExport(path, exportFormatAuto)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", path, err)
+		}
+		if len(bookmarks) != expectedCount {
+			t.Errorf("%s: expected %d bookmarks, got %d", path, expectedCount, len(bookmarks))
+		}
+		if bookmark := bookmarks["https://example.com/1"]; bookmark == nil || bookmark.ContainingFolder != "Unread" {
+			t.Errorf("%s: expected https://example.com/1 in Unread, got %+v", path, bookmark)
+		}
+	}
+
+	if _, err := readBookmarksFromExport(htmlPath, "xml"); err == nil {
+		t.Error("expected an error for an unsupported export format")
+	}
+}
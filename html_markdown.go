@@ -0,0 +1,198 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	markdownWhitespace   = regexp.MustCompile(`\s+`)
+	markdownBlankLines   = regexp.MustCompile(`\n{3,}`)
+	markdownEscapedChars = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`)
+)
+
+// htmlToMarkdown converts the HTML returned by Instapaper's text endpoint
+// into Markdown. Anything it doesn't understand is reduced to its text.
+func htmlToMarkdown(input string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		return "", err
+	}
+	markdown := markdownChildren(doc)
+
+	lines := strings.Split(markdown, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[i] = ""
+		}
+	}
+	markdown = markdownBlankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(markdown), nil
+}
+
+func markdownChildren(n *html.Node) string {
+	var buf strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		buf.WriteString(markdownNode(c))
+	}
+	return buf.String()
+}
+
+func markdownNode(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return markdownEscapedChars.Replace(markdownWhitespace.ReplaceAllString(n.Data, " "))
+	case html.ElementNode:
+		// handled below
+	case html.DocumentNode:
+		return markdownChildren(n)
+	default:
+		return ""
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Noscript, atom.Template:
+		return ""
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level, _ := strconv.Atoi(n.Data[1:])
+		text := strings.TrimSpace(markdownWhitespace.ReplaceAllString(markdownChildren(n), " "))
+		if text == "" {
+			return ""
+		}
+		return "\n\n" + strings.Repeat("#", level) + " " + text + "\n\n"
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Main, atom.Header, atom.Footer,
+		atom.Figure, atom.Figcaption, atom.Aside, atom.Table, atom.Tr, atom.Td, atom.Th, atom.Dt, atom.Dd:
+		return "\n\n" + strings.TrimSpace(markdownChildren(n)) + "\n\n"
+	case atom.Br:
+		return "  \n"
+	case atom.Hr:
+		return "\n\n---\n\n"
+	case atom.Strong, atom.B:
+		return markdownWrapInline(markdownChildren(n), "**")
+	case atom.Em, atom.I, atom.Cite:
+		return markdownWrapInline(markdownChildren(n), "_")
+	case atom.Code, atom.Kbd, atom.Samp:
+		return markdownWrapInline(markdownText(n), "`")
+	case atom.Pre:
+		return "\n\n```\n" + strings.Trim(markdownText(n), "\n") + "\n```\n\n"
+	case atom.A:
+		text := strings.TrimSpace(markdownChildren(n))
+		href := markdownAttr(n, "href")
+		if href == "" || strings.HasPrefix(href, "#") || text == "" {
+			return text
+		}
+		return "[" + text + "](" + href + ")"
+	case atom.Img:
+		src := markdownAttr(n, "src")
+		if src == "" {
+			return ""
+		}
+		return "![" + markdownEscapedChars.Replace(markdownAttr(n, "alt")) + "](" + src + ")"
+	case atom.Ul, atom.Ol:
+		return "\n\n" + markdownList(n) + "\n\n"
+	case atom.Blockquote:
+		quoted := strings.TrimSpace(markdownBlankLines.ReplaceAllString(markdownChildren(n), "\n\n"))
+		return "\n\n" + markdownPrefixLines(quoted, "> ", ">") + "\n\n"
+	default:
+		return markdownChildren(n)
+	}
+}
+
+// markdownList renders the <li> children of a <ul> or <ol>, indenting any
+// continuation lines so nested blocks stay inside their item.
+func markdownList(n *html.Node) string {
+	var items []string
+	number := 1
+	if start, err := strconv.Atoi(markdownAttr(n, "start")); err == nil {
+		number = start
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		content := strings.TrimSpace(markdownBlankLines.ReplaceAllString(markdownChildren(c), "\n\n"))
+		indent := strings.Repeat(" ", len(marker))
+		items = append(items, marker+strings.TrimPrefix(markdownPrefixLines(content, indent, ""), indent))
+	}
+	return strings.Join(items, "\n")
+}
+
+func markdownPrefixLines(s, prefix, blankPrefix string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[i] = blankPrefix
+		} else {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func markdownWrapInline(s, delimiter string) string {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return s
+	}
+	// Keep surrounding whitespace outside the delimiters, otherwise they
+	// aren't treated as emphasis.
+	leading := s[:strings.Index(s, trimmed)]
+	trailing := s[len(leading)+len(trimmed):]
+	return leading + delimiter + trimmed + delimiter + trailing
+}
+
+// markdownText returns the unescaped text content of n, preserving
+// whitespace.
+func markdownText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var buf strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		buf.WriteString(markdownText(c))
+	}
+	return buf.String()
+}
+
+func markdownAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return strings.TrimSpace(attr.Val)
+		}
+	}
+	return ""
+}
+
+// htmlToText returns the visible text of an HTML document with whitespace
+// collapsed, for indexing.
+func htmlToText(input string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			buf.WriteString(n.Data)
+			buf.WriteString(" ")
+		case n.Type == html.ElementNode && (n.DataAtom == atom.Head || n.DataAtom == atom.Script || n.DataAtom == atom.Style || n.DataAtom == atom.Noscript):
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return strings.TrimSpace(markdownWhitespace.ReplaceAllString(buf.String(), " ")), nil
+}
@@ -0,0 +1,73 @@
+(function () {
+  var input = document.getElementById("search");
+  var results = document.getElementById("results");
+  var maxResults = 100;
+
+  function haystack(entry) {
+    if (!entry.haystack) {
+      entry.haystack = [entry.title, entry.url, entry.folder, entry.highlights, entry.text]
+        .join("\n")
+        .toLowerCase();
+    }
+    return entry.haystack;
+  }
+
+  function snippet(entry, term) {
+    var text = entry.text || "";
+    var i = text.toLowerCase().indexOf(term);
+    if (i < 0) {
+      return "";
+    }
+    var start = Math.max(0, i - 80);
+    var end = Math.min(text.length, i + term.length + 80);
+    return (start > 0 ? "…" : "") + text.slice(start, end) + (end < text.length ? "…" : "");
+  }
+
+  function render(query) {
+    var terms = query.toLowerCase().split(/\s+/).filter(Boolean);
+    results.textContent = "";
+    if (terms.length === 0) {
+      return;
+    }
+    var matches = searchIndex.filter(function (entry) {
+      var text = haystack(entry);
+      return terms.every(function (term) {
+        return text.indexOf(term) >= 0;
+      });
+    });
+    matches.slice(0, maxResults).forEach(function (entry) {
+      var li = document.createElement("li");
+      var a = document.createElement("a");
+      a.href = entry.path;
+      a.textContent = entry.title;
+      li.appendChild(a);
+      var meta = document.createElement("span");
+      meta.className = "meta";
+      meta.textContent = entry.date + (entry.folder ? " · " + entry.folder : "");
+      li.appendChild(meta);
+      var text = snippet(entry, terms[0]);
+      if (text) {
+        var span = document.createElement("span");
+        span.className = "snippet";
+        span.textContent = text;
+        li.appendChild(span);
+      }
+      results.appendChild(li);
+    });
+    if (matches.length === 0) {
+      results.textContent = "No results.";
+    } else if (matches.length > maxResults) {
+      var more = document.createElement("li");
+      more.textContent = (matches.length - maxResults) + " more…";
+      results.appendChild(more);
+    }
+  }
+
+  input.addEventListener("input", function () {
+    render(input.value);
+  });
+  if (location.hash.length > 1) {
+    input.value = decodeURIComponent(location.hash.slice(1));
+    render(input.value);
+  }
+})();
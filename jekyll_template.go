@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultJekyllPostTemplate renders the posts written when no template is
+// given.
+const defaultJekyllPostTemplate = `---
+{{ yaml .FrontMatter -}}
+---
+
+{{ if .FullText -}}
+{% raw %}
+{{ .FullText }}
+{% endraw %}
+{{ end -}}
+`
+
+// postData describes a bookmark for rendering a post. Jekyll post templates
+// are executed with it.
+type postData struct {
+	ID          string
+	Hash        string
+	URL         string
+	Title       string
+	Description string
+	// Selection is the text selected when the bookmark was saved, if any.
+	Selection string
+	Folder    string
+	Tags      []string
+	// Date is the day the bookmark was saved, at midnight UTC.
+	Date time.Time
+	// Saved is when the bookmark was saved, if known.
+	Saved    time.Time
+	Progress float32
+	Starred  bool
+	// FullText is the HTML of the article, if it could be fetched.
+	FullText string
+	// TextSource is where FullText came from: "instapaper", or "original"
+	// if it was extracted from the original page.
+	TextSource string
+	Highlights []instapaper.Highlight
+	// FrontMatter is the default front matter for the post.
+	FrontMatter jekyllFrontMatter
+}
+
+// jekyllFrontMatter is the front matter the default template writes.
+type jekyllFrontMatter struct {
+	ArchiveID      string    `yaml:"archive_id"`
+	Title          string    `yaml:"title"`
+	Category       string    `yaml:"category"`
+	URL            string    `yaml:"url"`
+	Saved          time.Time `yaml:"saved,omitempty"`
+	Description    string    `yaml:"description,omitempty"`
+	Tags           []string  `yaml:"tags,omitempty"`
+	Starred        bool      `yaml:"starred"`
+	Progress       float32   `yaml:"progress"`
+	HighlightCount int       `yaml:"highlight_count"`
+	TextSource     string    `yaml:"text_source,omitempty"`
+}
+
+func newPostData(bookmark bookmarkData) postData {
+	data := postData{
+		ID:         bookmark.GetID(),
+		Hash:       bookmark.GetHash(),
+		URL:        bookmark.GetURL(),
+		Title:      bookmark.GetTitle(),
+		Folder:     bookmark.ContainingFolder,
+		FullText:   bookmark.FullText,
+		TextSource: bookmark.TextSource,
+		Highlights: bookmark.Highlights,
+	}
+	data.Date, _ = time.Parse("2006-01-02", bookmark.GetYYYYMMDD())
+	if bookmark.Bookmark != nil && bookmark.Bookmark.Time > 0 {
+		data.Saved = time.Unix(int64(bookmark.Bookmark.Time), 0).UTC()
+	} else if bookmark.BookmarkExportMeta != nil {
+		if unix, err := strconv.ParseInt(bookmark.BookmarkExportMeta.Timestamp, 10, 64); err == nil {
+			data.Saved = time.Unix(unix, 0).UTC()
+		}
+	}
+	if bookmark.Bookmark != nil {
+		data.Description = bookmark.Bookmark.Description
+		data.Progress = bookmark.Bookmark.Progress
+		data.Starred = bookmark.Bookmark.Starred == "1"
+	}
+	if bookmark.BookmarkExportMeta != nil {
+		data.Selection = bookmark.BookmarkExportMeta.Selection
+		data.Tags = bookmark.BookmarkExportMeta.Tags
+	}
+	data.FrontMatter = jekyllFrontMatter{
+		ArchiveID:      data.ID,
+		Title:          data.Title,
+		Category:       data.Folder,
+		URL:            data.URL,
+		Saved:          data.Saved,
+		Description:    data.Description,
+		Tags:           data.Tags,
+		Starred:        data.Starred,
+		Progress:       data.Progress,
+		HighlightCount: len(data.Highlights),
+		TextSource:     data.TextSource,
+	}
+	return data
+}
+
+// jekyllTemplateFuncs are available to Jekyll post templates:
+//
+//	date "2006-01-02" .Date   formats a time with a Go layout
+//	escape .Title             escapes double quotes
+//	quote .Title              quotes and escapes a string
+//	json .Tags                encodes a value as JSON, which is also YAML
+//	yaml .FrontMatter         encodes a value as a YAML document
+//	join .Tags ", "           joins strings with a separator
+var jekyllTemplateFuncs = template.FuncMap{
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"escape": func(s string) string {
+		return strings.ReplaceAll(s, `"`, `\"`)
+	},
+	"quote": strconv.Quote,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join": strings.Join,
+	"yaml": func(v interface{}) (string, error) {
+		data, err := yaml.Marshal(v)
+		return string(data), err
+	},
+}
+
+// parseJekyllPostTemplate parses the template in path, or the default
+// template if path is empty.
+func parseJekyllPostTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return template.New("post").Funcs(jekyllTemplateFuncs).Parse(defaultJekyllPostTemplate)
+	}
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filepath.Base(path)).Funcs(jekyllTemplateFuncs).Parse(string(text))
+}
+
+// defaultJekyllPostTemplateParsed is used by writers without a template.
+var defaultJekyllPostTemplateParsed = template.Must(parseJekyllPostTemplate(""))
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+	"gopkg.in/yaml.v3"
+)
+
+func renderTestJekyllPost(t *testing.T, templatePath string, bookmark bookmarkData) string {
+	t.Helper()
+	tmpl, err := parseJekyllPostTemplate(templatePath)
+	if err != nil {
+		t.Fatalf("unable to parse template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, newPostData(bookmark)); err != nil {
+		t.Fatalf("unable to execute template: %v", err)
+	}
+	return buf.String()
+}
+
+// splitTestFrontMatter returns the front matter and body of a post.
+func splitTestFrontMatter(t *testing.T, post string) (string, string) {
+	t.Helper()
+	parts := strings.SplitN(post, "---\n", 3)
+	if len(parts) != 3 || parts[0] != "" {
+		t.Fatalf("post has no front matter:\n%s", post)
+	}
+	return parts[1], parts[2]
+}
+
+func TestDefaultJekyllPostTemplate(t *testing.T) {
+	bookmark := bookmarkData{
+		Bookmark:         &instapaper.Bookmark{ID: 1234, Title: "Title", URL: "https://example.com/1234", Time: 1288608076},
+		FullText:         "<p>full text</p>",
+		ContainingFolder: "Unread",
+	}
+	_, body := splitTestFrontMatter(t, renderTestJekyllPost(t, "", bookmark))
+	if expected := "\n{% raw %}\n<p>full text</p>\n{% endraw %}\n"; body != expected {
+		t.Errorf("expected body %q, got %q", expected, body)
+	}
+
+	bookmark.FullText = ""
+	_, body = splitTestFrontMatter(t, renderTestJekyllPost(t, "", bookmark))
+	if body != "\n" {
+		t.Errorf("expected an empty body, got %q", body)
+	}
+}
+
+func TestDefaultJekyllPostTemplateFrontMatterRoundTrips(t *testing.T) {
+	titles := []string{
+		`A "quoted" title`,
+		`C:\Windows\System32`,
+		"Title: with a colon",
+		"A title\nover two lines",
+		"- looks like a list",
+		"# looks like a comment",
+		"{% raw %} and {{ liquid }}",
+		"1234",
+		"yes",
+	}
+	for _, title := range titles {
+		bookmark := bookmarkData{
+			Bookmark: &instapaper.Bookmark{
+				ID:          1234,
+				Title:       title,
+				URL:         "https://example.com/1234?a=b&c=d#e",
+				Description: "Description: \"with\" 'quotes'",
+				Time:        1288608076,
+				Progress:    0.25,
+				Starred:     "1",
+			},
+			BookmarkExportMeta: &bookmarkExportMeta{Tags: []string{"go", "a: b"}},
+			Highlights:         []instapaper.Highlight{{Text: "One"}, {Text: "Two"}},
+			ContainingFolder:   `Folder "with" quotes: and colons`,
+		}
+		frontMatter, _ := splitTestFrontMatter(t, renderTestJekyllPost(t, "", bookmark))
+
+		var actual jekyllFrontMatter
+		if err := yaml.Unmarshal([]byte(frontMatter), &actual); err != nil {
+			t.Errorf("title %q: front matter is not valid YAML: %v\n%s", title, err, frontMatter)
+			continue
+		}
+		expected := jekyllFrontMatter{
+			ArchiveID:      "1234",
+			Title:          title,
+			Category:       bookmark.ContainingFolder,
+			URL:            bookmark.Bookmark.URL,
+			Saved:          time.Unix(int64(bookmark.Bookmark.Time), 0).UTC(),
+			Description:    bookmark.Bookmark.Description,
+			Tags:           []string{"go", "a: b"},
+			Starred:        true,
+			Progress:       0.25,
+			HighlightCount: 2,
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("title %q: expected %+v, got %+v", title, expected, actual)
+		}
+	}
+}
+
+func TestCustomJekyllPostTemplate(t *testing.T) {
+	dir := filepath.Join("tmp", "jekyllTemplate")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTestTmpDir(dir)
+	templatePath := filepath.Join(dir, "post.md.tmpl")
+	template := `---
+title: {{ quote .Title }}
+url: {{ quote .URL }}
+date: {{ date "2006-01-02" .Date }}
+tags: {{ json .Tags }}
+progress: {{ .Progress }}
+starred: {{ .Starred }}
+---
+{{ range .Highlights }}
+> {{ .Text }}
+{{ end -}}
+`
+	if err := ioutil.WriteFile(templatePath, []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bookmark := bookmarkData{
+		Bookmark: &instapaper.Bookmark{
+			ID:       1234,
+			Title:    `A "quoted" title`,
+			URL:      "https://example.com/1234",
+			Time:     1288608076,
+			Progress: 0.25,
+			Starred:  "1",
+		},
+		BookmarkExportMeta: &bookmarkExportMeta{Tags: []string{"go", "web"}},
+		Highlights:         []instapaper.Highlight{{Text: "A highlight"}},
+	}
+	expected := `---
+title: "A \"quoted\" title"
+url: "https://example.com/1234"
+date: 2010-11-01
+tags: ["go","web"]
+progress: 0.25
+starred: true
+---
+
+> A highlight
+`
+	if actual := renderTestJekyllPost(t, templatePath, bookmark); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestJekyllOutputWriter_PostExtension(t *testing.T) {
+	dir := filepath.Join("tmp", "jekyllPostExtension")
+	w := jekyllOutputWriter{Directory: dir, PostExtension: "md"}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(dir)
+	bookmark := bookmarkData{Bookmark: &instapaper.Bookmark{ID: 1234, Time: 1288608076}}
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, filepath.Join(dir, "_posts", "2010-11-01-1234.md"), `archive_id: "1234"`)
+}
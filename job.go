@@ -1,50 +1,151 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
-
-	"github.com/ochronus/instapaper-go-client/instapaper"
+	"time"
 )
 
 type OutputWriter interface {
 	Preflight() error
 	Write(bookmarkData) error
+	Close() error
 }
 
 type InstapaperBookmarkDownloadJob struct {
-	APIClient        *instapaper.Client
-	BookmarkService  *instapaper.BookmarkService
-	HighlightService *instapaper.HighlightService
-	Directory        string
-	BookmarkData     *bookmarkData
-	OutputWriter     OutputWriter
+	API          *instapaperAPI
+	Directory    string
+	BookmarkData *bookmarkData
+	OutputWriter OutputWriter
+	Store        *bookmarkStore
+	Assets       *assetMirror
+	Capture      *pageCapture
+	RateLimiter  *apiRateLimiter
+	Progress     *progressReporter
+}
+
+func (j *InstapaperBookmarkDownloadJob) ID() string {
+	return j.BookmarkData.GetID()
 }
 
-func (j *InstapaperBookmarkDownloadJob) Process() error {
-	log.Printf("[%s] data: %s", j.BookmarkData.GetID(), j.BookmarkData)
+func (j *InstapaperBookmarkDownloadJob) Process(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	slog.Debug("archiving bookmark", j.BookmarkData.logArgs()...)
+	var fetchErr error
 	if j.BookmarkData.Bookmark != nil && j.BookmarkData.Bookmark.ID > 0 {
 		// Fill out what we can.
-		var err error
-		j.BookmarkData.FullText, err = j.BookmarkService.GetText(j.BookmarkData.Bookmark.ID)
-		if err != nil {
-			log.Printf("[%s] error fetching full text: %v", j.BookmarkData.GetID(), err)
+		stageStart := time.Now()
+		err := j.RateLimiter.Do(ctx, func() error {
+			var err error
+			j.BookmarkData.FullText, err = j.API.GetText(j.BookmarkData.Bookmark.ID)
+			return err
+		})
+		if err := j.recordFetchError(fetchStageText, stageStart, err); err != nil {
+			fetchErr = err
+		} else if len(j.BookmarkData.FullText) > 0 {
+			// An empty text view isn't trusted over text archived before,
+			// which may have been captured from the original page.
+			j.BookmarkData.TextFetched = true
+			j.BookmarkData.TextSource = textSourceInstapaper
+			j.Progress.FullTextFetched()
 		}
-		j.BookmarkData.Highlights, err = j.HighlightService.List(j.BookmarkData.Bookmark.ID)
-		if err != nil {
-			log.Printf("[%s] error fetching highlights: %v", j.BookmarkData.GetID(), err)
+		stageStart = time.Now()
+		err = j.RateLimiter.Do(ctx, func() error {
+			var err error
+			j.BookmarkData.Highlights, err = j.API.ListHighlights(j.BookmarkData.Bookmark.ID)
+			return err
+		})
+		if recordErr := j.recordFetchError(fetchStageHighlights, stageStart, err); recordErr != nil {
+			fetchErr = recordErr
+		} else if err == nil {
+			j.BookmarkData.HighlightsFetched = true
+			j.Progress.HighlightsFetched(len(j.BookmarkData.Highlights))
 		}
-
+	}
+	if j.Capture != nil && len(j.BookmarkData.FullText) == 0 && ctx.Err() == nil {
+		j.captureOriginalPage(ctx)
+	}
+	if j.Assets != nil && len(j.BookmarkData.FullText) > 0 {
+		stageStart := time.Now()
+		assets, err := j.Assets.Mirror(ctx, j.BookmarkData.FullText, j.BookmarkData.GetURL())
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("error mirroring assets", j.BookmarkData.logArgs("stage", logStageAssets, "duration", time.Since(stageStart), "error", err)...)
+		}
+		j.BookmarkData.Assets = assets
+	}
+	if err := ctx.Err(); err != nil {
+		// Don't archive what we have if we were interrupted.
+		return err
+	}
+	stageStart := time.Now()
+	if err := j.Store.Save(*j.BookmarkData); err != nil {
+		slog.Error("error storing bookmark", j.BookmarkData.logArgs("stage", logStageWrite, "duration", time.Since(stageStart), "error", err)...)
+		return err
 	}
 	if err := j.OutputWriter.Write(*j.BookmarkData); err != nil {
-		log.Printf("[%s] error writing: %v", j.BookmarkData.GetID(), err)
+		slog.Error("error writing bookmark", j.BookmarkData.logArgs("stage", logStageWrite, "duration", time.Since(stageStart), "error", err)...)
 		return err
 	}
-	log.Printf("[%s] archived bookmark", j.BookmarkData.GetID())
+	if fetchErr != nil {
+		// What we have is archived, but the next run should try again.
+		return fetchErr
+	}
+	slog.Debug("archived bookmark", j.BookmarkData.logArgs("stage", logStageWrite, "duration", time.Since(start))...)
 	return nil
 }
 
+// captureOriginalPage falls back to the text of the original page, unless
+// text has already been archived for the bookmark. Failures are only
+// logged, since the bookmark is still worth archiving without text.
+func (j *InstapaperBookmarkDownloadJob) captureOriginalPage(ctx context.Context) {
+	start := time.Now()
+	// Saving the bookmark reports any error reading the store.
+	archived, err := j.Store.HasFullText(j.BookmarkData.GetID())
+	if err != nil || archived {
+		return
+	}
+	fullText, err := j.Capture.Capture(ctx, *j.BookmarkData)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Warn("original page unavailable", j.BookmarkData.logArgs("stage", fetchStageOriginal, "duration", time.Since(start), "error", err)...)
+		}
+		return
+	}
+	slog.Debug("fetched original page", j.BookmarkData.logArgs("stage", fetchStageOriginal, "duration", time.Since(start))...)
+	j.BookmarkData.FullText = fullText
+	j.BookmarkData.TextFetched = true
+	j.BookmarkData.TextSource = textSourceOriginal
+	j.Progress.FullTextFetched()
+}
+
+// recordFetchError notes permanent failures on the bookmark so they're
+// archived alongside it, and returns any other error.
+func (j *InstapaperBookmarkDownloadJob) recordFetchError(stage string, start time.Time, err error) error {
+	if err == nil {
+		slog.Debug("fetched "+stage, j.BookmarkData.logArgs("stage", stage, "duration", time.Since(start))...)
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if isPermanentAPIError(err) {
+		slog.Warn(stage+" unavailable", j.BookmarkData.logArgs("stage", stage, "duration", time.Since(start), "error", err)...)
+		if j.BookmarkData.FetchErrors == nil {
+			j.BookmarkData.FetchErrors = map[string]string{}
+		}
+		j.BookmarkData.FetchErrors[stage] = err.Error()
+		return nil
+	}
+	slog.Error("error fetching "+stage, j.BookmarkData.logArgs("stage", stage, "duration", time.Since(start), "error", err)...)
+	return fmt.Errorf("error fetching %s: %v", stage, err)
+}
+
 func fileExists(filename string) bool {
 	_, err := os.Stat(filename)
 	return !errors.Is(err, os.ErrNotExist)
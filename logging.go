@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Stages of archiving a bookmark, for structured logs. Fetching uses
+// fetchStageText and fetchStageHighlights.
+const (
+	logStageList   = "list"
+	logStageAssets = "assets"
+	logStageWrite  = "write"
+)
+
+// structuredLogging is set when logs are written as JSON, so fatal errors
+// are too.
+var structuredLogging bool
+
+// configureLogging sets up the default logger. The "text" format keeps the
+// standard log output; "json" writes one JSON record per line to stderr.
+// Both the slog and log packages go through it.
+func configureLogging(format, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unsupported log level %q", level)
+	}
+	switch strings.ToLower(format) {
+	case "text":
+		slog.SetLogLoggerLevel(logLevel)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+		structuredLogging = true
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+	return nil
+}
+
+// logArgs returns the fields identifying a bookmark in structured logs,
+// followed by args.
+func (d *bookmarkData) logArgs(args ...interface{}) []interface{} {
+	return append([]interface{}{
+		"bookmark_id", d.GetID(),
+		"url", d.GetURL(),
+		"folder", d.ContainingFolder,
+	}, args...)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+func TestBookmarkDataLogArgs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	bookmark := bookmarkData{
+		Bookmark:         &instapaper.Bookmark{ID: 1234, URL: "https://example.com/a", Hash: "abc"},
+		ContainingFolder: "starred",
+	}
+	logger.Error("error writing bookmark", bookmark.logArgs("stage", logStageWrite, "error", errors.New("disk full"))...)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log record is not JSON: %v: %s", err, buf.String())
+	}
+	expected := map[string]interface{}{
+		"level":       "ERROR",
+		"msg":         "error writing bookmark",
+		"bookmark_id": "1234",
+		"url":         "https://example.com/a",
+		"folder":      "starred",
+		"stage":       "write",
+		"error":       "disk full",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, record[key])
+		}
+	}
+}
+
+func TestConfigureLoggingRejectsUnknownValues(t *testing.T) {
+	if err := configureLogging("xml", "info"); err == nil {
+		t.Error("expected an error for an unknown log format")
+	}
+	if err := configureLogging("text", "chatty"); err == nil {
+		t.Error("expected an error for an unknown log level")
+	}
+}
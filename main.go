@@ -1,21 +1,52 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
-	"runtime"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ochronus/instapaper-go-client/instapaper"
 )
 
+// bookmarkListPageSize is the most bookmarks the API returns per request.
+const bookmarkListPageSize = 500
+
+// haveBatchSize is how many bookmark IDs are sent in each 'have' parameter,
+// about 100KB of them, so requests stay a reasonable size however big the
+// folder.
+const haveBatchSize = 10000
+
+// defaultExportCSVFileName is read if no exports are given and it exists.
+const defaultExportCSVFileName = "instapaper-export.csv"
+
+// stringListFlag is a flag which can be given more than once.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func fatal(format string, args ...interface{}) {
-	fmt.Printf("fatal: "+format+"\n", args...)
+	if structuredLogging {
+		slog.Error("fatal: " + fmt.Sprintf(format, args...))
+	} else {
+		fmt.Printf("fatal: "+format+"\n", args...)
+	}
 	os.Exit(1)
 }
 
@@ -33,7 +64,7 @@ func readPassword(passwordFile string) (string, error) {
 	return strings.TrimSpace(string(data)), err
 }
 
-func newInstapaperClient(emailAddress, password string) (*instapaper.Client, error) {
+func newInstapaperClient(emailAddress, password string) (*instapaperAPI, error) {
 	apiClient, err := instapaper.NewClient(
 		os.Getenv("INSTAPAPER_CLIENT_ID"),
 		os.Getenv("INSTAPAPER_CLIENT_SECRET"),
@@ -43,119 +74,181 @@ func newInstapaperClient(emailAddress, password string) (*instapaper.Client, err
 	if err != nil {
 		return nil, fmt.Errorf("error initializing the client: %v", err)
 	}
-	authErr := apiClient.Authenticate()
+	api := &instapaperAPI{Client: &apiClient, HTTPClient: newAPIHTTPClient()}
+	authErr := api.Authenticate()
 	if authErr != nil {
 		return nil, fmt.Errorf("error authenticating: %v", authErr)
 	}
-	return &apiClient, nil
+	return api, nil
 }
 
-func createInstapaperArchive(client instapaper.Client, directory string, exportCSVFileName string, outputWriter OutputWriter, queue *JobQueue) error {
+// createInstapaperArchive lists every bookmark and submits a job to archive
+// each of them, until ctx is done. It returns the number of bookmarks found.
+func createInstapaperArchive(ctx context.Context, api *instapaperAPI, directory string, exportFileNames []string, exportFormat string, outputWriter OutputWriter, assets *assetMirror, capture *pageCapture, queue *JobQueue, rateLimiter *apiRateLimiter, progress *progressReporter) (int, error) {
 	// 0. Create directories
 	if err := outputWriter.Preflight(); err != nil {
-		return err
+		return 0, err
+	}
+	store := newBookmarkStore(directory)
+	if err := store.Preflight(); err != nil {
+		return 0, err
+	}
+	if err := assets.Load(); err != nil {
+		return 0, err
+	}
+	if err := capture.Preflight(); err != nil {
+		return 0, err
 	}
 
-	bookmarkService := instapaper.BookmarkService{Client: client}
-	highlightService := instapaper.HighlightService{Client: client}
-	folderService := instapaper.FolderService{Client: client}
-
-	// 1. Read in instapaper-export.csv, which has URLs but no IDs
+	// 1. Read in any exports, e.g. instapaper-export.csv, which have URLs but no IDs
 	// Download from https://www.instapaper.com/user -> Download .CSV file
-	allBookmarks, err := readBookmarksFromCSVExport(exportCSVFileName)
+	allBookmarks, err := readBookmarksFromExports(exportFileNames, exportFormat)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// 2. List folders and get all the bookmarks we can from them.
-	// I can't get pagination to work with the 'have' parameter.
-	folders, err := folderService.List()
-	if err != nil {
+	// 2. List folders and page through all the bookmarks in each of them.
+	var folders []instapaper.Folder
+	err = rateLimiter.Do(ctx, func() error {
+		var err error
+		folders, err = api.ListFolders()
 		return err
+	})
+	if err != nil {
+		return 0, err
 	}
 	folders = append(folders,
 		instapaper.Folder{ID: instapaper.FolderIDUnread, Title: "Unread", Slug: "unread"},
 		instapaper.Folder{ID: instapaper.FolderIDStarred, Title: "Starred", Slug: "starred"},
 		instapaper.Folder{ID: instapaper.FolderIDArchive, Title: "Archive", Slug: "archive"},
 	)
-	err = listBookmarksFromFolders(bookmarkService, folders, allBookmarks)
+	err = listBookmarksFromFolders(ctx, api, folders, allBookmarks, rateLimiter)
 	if err != nil {
-		return err
+		return len(allBookmarks), err
 	}
 
-	// 2. Enqueue bookmarks to be archived.
-	log.Printf("Bookmarks to archive: %d", len(allBookmarks))
+	// 3. Enqueue bookmarks to be archived.
+	slog.Info("bookmarks to archive", "count", len(allBookmarks))
+	fromCSV, fromAPI := 0, 0
+	for _, bookmarkDatum := range allBookmarks {
+		if bookmarkDatum.BookmarkExportMeta != nil {
+			fromCSV++
+		}
+		if bookmarkDatum.Bookmark != nil {
+			fromAPI++
+		}
+	}
+	progress.Discovered(len(allBookmarks), fromCSV, fromAPI)
 	for _, bookmarkDatum := range allBookmarks {
-		queue.Submit(&InstapaperBookmarkDownloadJob{
-			BookmarkData:     bookmarkDatum,
-			Directory:        directory,
-			APIClient:        &client,
-			BookmarkService:  &bookmarkService,
-			HighlightService: &highlightService,
-			OutputWriter:     outputWriter,
+		err := queue.Submit(ctx, &InstapaperBookmarkDownloadJob{
+			BookmarkData: bookmarkDatum,
+			Directory:    directory,
+			API:          api,
+			OutputWriter: outputWriter,
+			Store:        store,
+			Assets:       assets,
+			Capture:      capture,
+			RateLimiter:  rateLimiter,
+			Progress:     progress,
 		})
+		if err != nil {
+			return len(allBookmarks), err
+		}
 	}
 
-	return nil
+	return len(allBookmarks), nil
 }
 
-func listBookmarksFromFolders(bookmarkService instapaper.BookmarkService, folders []instapaper.Folder, bookmarks map[string]*bookmarkData) error {
+func listBookmarksFromFolders(ctx context.Context, api *instapaperAPI, folders []instapaper.Folder, bookmarks map[string]*bookmarkData, rateLimiter *apiRateLimiter) error {
 	for _, folder := range folders {
-		resp, err := bookmarkService.List(instapaper.BookmarkListRequestParams{
-			// this is limited to 500 by the API, and pagination doesn't work,
-			// so only the latest 500 bookmarks are returned.
-			Limit:  100000,
-			Folder: folder.ID.String(),
-		})
-		if err != nil {
+		if err := listBookmarksFromFolder(ctx, api, folder, bookmarks, rateLimiter); err != nil {
 			return err
 		}
-		for _, bookmark := range resp.Bookmarks {
-			bookmark := bookmark
-			data, ok := bookmarks[bookmark.URL]
-			if ok {
-				data.Bookmark = &bookmark
-			} else {
-				bookmarks[bookmark.URL] = &bookmarkData{Bookmark: &bookmark, ContainingFolder: folder.Slug}
+	}
+	return nil
+}
+
+// listBookmarksFromFolder pages through a folder by sending the IDs of the
+// bookmarks we've already seen as the 'have' parameter until the API returns
+// less than a full page. Once there are more than haveBatchSize of them,
+// each page is requested once per batch and the results are merged. If
+// that stops turning up new bookmarks before the end of the folder, it's an
+// error rather than silently losing the rest.
+func listBookmarksFromFolder(ctx context.Context, api *instapaperAPI, folder instapaper.Folder, bookmarks map[string]*bookmarkData, rateLimiter *apiRateLimiter) error {
+	start := time.Now()
+	seen := map[int]bool{}
+	have := []string{}
+	for {
+		newBookmarks := 0
+		lastPage := false
+		for _, batch := range haveBatches(have) {
+			var resp *instapaper.BookmarkListResponse
+			err := rateLimiter.Do(ctx, func() error {
+				var err error
+				resp, err = api.ListBookmarks(folder.ID.String(), strings.Join(batch, ","), bookmarkListPageSize)
+				return err
+			})
+			if err != nil {
+				return err
 			}
+			for _, bookmark := range resp.Bookmarks {
+				bookmark := bookmark
+				if seen[bookmark.ID] {
+					continue
+				}
+				seen[bookmark.ID] = true
+				have = append(have, strconv.Itoa(bookmark.ID))
+				newBookmarks++
+				data, ok := bookmarks[bookmark.URL]
+				if ok {
+					data.Bookmark = &bookmark
+				} else {
+					bookmarks[bookmark.URL] = &bookmarkData{Bookmark: &bookmark, ContainingFolder: folder.Slug}
+				}
+			}
+			if len(resp.Bookmarks) < bookmarkListPageSize {
+				// Everything but this batch has been listed, and the batch
+				// was seen already.
+				lastPage = true
+				break
+			}
+		}
+		if lastPage {
+			break
+		}
+		if newBookmarks == 0 {
+			return fmt.Errorf("folder %q stopped returning new bookmarks after %d, before its last page", folder.Slug, len(seen))
 		}
 	}
+	slog.Info("listed bookmarks", "folder", folder.Slug, "stage", logStageList, "count", len(seen), "duration", time.Since(start))
 	return nil
 }
 
-func readBookmarksFromCSVExport(exportCSVFileName string) (map[string]*bookmarkData, error) {
-	csvFile, err := os.Open(exportCSVFileName)
-	if err != nil {
-		return nil, err
+// haveBatches splits the IDs to send as 'have' into batches of at most
+// haveBatchSize. There's always at least one, which may be empty.
+func haveBatches(have []string) [][]string {
+	batches := [][]string{}
+	for len(have) > haveBatchSize {
+		batches = append(batches, have[:haveBatchSize])
+		have = have[haveBatchSize:]
 	}
-	records, err := csv.NewReader(csvFile).ReadAll()
-	if err != nil {
-		return nil, err
-	}
-	bookmarks := map[string]*bookmarkData{}
-	for i := range records[1:] {
-		row := records[i]
-		url := row[0]
-		if url == "URL" {
-			// CSV title row
-			continue
+	return append(batches, have)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "search" {
+		if err := runSearch(os.Args[2:], os.Stdout); err != nil {
+			fatal("error searching archive: %v", err)
 		}
-		bookmarks[url] = &bookmarkData{
-			BookmarkExportMeta: &bookmarkExportMeta{
-				// URL,Title,Selection,Folder,Timestamp
-				URL:       url,
-				Title:     row[1],
-				Selection: row[2],
-				Folder:    row[3],
-				Timestamp: row[4],
-			},
-			ContainingFolder: row[3],
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		if err := runRender(os.Args[2:], os.Stdout); err != nil {
+			fatal("error rendering archive: %v", err)
 		}
+		return
 	}
-	return bookmarks, nil
-}
 
-func main() {
 	var emailAddress string
 	flag.StringVar(&emailAddress, "email", "", "The email address for the login credentials")
 	var passwordFile string
@@ -164,14 +257,62 @@ func main() {
 	flag.StringVar(&password, "password", "", "The password associated with the given email")
 	var directory string
 	flag.StringVar(&directory, "directory", "archive", "The directory in which to write the archive")
-	var exportCSVFileName string
-	flag.StringVar(&exportCSVFileName, "export-csv-file", "instapaper-export.csv", "The path to the instapaper export CSV")
+	var exportFileNames stringListFlag
+	flag.Var(&exportFileNames, "export-csv-file", "The path to an instapaper export CSV or HTML; repeat for several (default \""+defaultExportCSVFileName+"\" if it exists)")
+	var exportFormat string
+	flag.StringVar(&exportFormat, "export-format", exportFormatAuto, "Format of the instapaper export (auto, csv or html)")
 	var numWorkers int
 	flag.IntVar(&numWorkers, "workers", 10, "Number of workers")
-	var outputFormat string
-	flag.StringVar(&outputFormat, "format", "jekyll", "Archive format")
+	var apiRate float64
+	flag.Float64Var(&apiRate, "api-rate", 2, "Maximum number of API requests per second")
+	var apiBurst int
+	flag.IntVar(&apiBurst, "api-burst", 4, "Maximum number of API requests to make at once before throttling to -api-rate")
+	var apiMaxAttempts int
+	flag.IntVar(&apiMaxAttempts, "api-max-attempts", 5, "Maximum number of times to try an API request which fails with a transient error")
+	var shutdownTimeout time.Duration
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to let in-flight bookmarks finish after an interrupt")
+	var progressInterval time.Duration
+	flag.DurationVar(&progressInterval, "progress-interval", 30*time.Second, "How often to log progress when not running in a terminal")
+	var logFormat string
+	flag.StringVar(&logFormat, "log-format", "text", "Log format (text or json)")
+	var logLevel string
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level to log (debug, info, warn or error)")
+	var offline bool
+	flag.BoolVar(&offline, "offline", false, "Rebuild the archive from the bookmarks stored by previous runs, without the API")
+	var mirrorAssets bool
+	flag.BoolVar(&mirrorAssets, "mirror-assets", false, "Download images in bookmarks' full text into _assets, for viewing offline")
+	var maxAssetSize int64
+	flag.Int64Var(&maxAssetSize, "max-asset-size", defaultAssetMaxSize, "Largest image to download with -mirror-assets, in bytes")
+	var capturePages bool
+	flag.BoolVar(&capturePages, "capture-pages", false, "Fetch the original page for bookmarks Instapaper has no text for")
+	var captureTimeout time.Duration
+	flag.DurationVar(&captureTimeout, "capture-timeout", defaultPageCaptureTimeout, "How long to wait for each original page with -capture-pages")
+	var maxPageSize int64
+	flag.Int64Var(&maxPageSize, "max-page-size", defaultPageCaptureMaxSize, "Largest original page to fetch with -capture-pages, in bytes")
+	var output outputOptions
+	output.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
+	if err := configureLogging(logFormat, logLevel); err != nil {
+		fatal("%v", err)
+	}
+	if len(exportFileNames) == 0 && fileExists(defaultExportCSVFileName) {
+		exportFileNames = stringListFlag{defaultExportCSVFileName}
+	}
+	if numWorkers < 1 {
+		fatal("-workers must be at least 1")
+	}
+	if apiRate <= 0 || apiBurst < 1 || apiMaxAttempts < 1 {
+		fatal("-api-rate must be positive, and -api-burst and -api-max-attempts must be at least 1")
+	}
+
+	if offline {
+		if err := renderArchive(directory, directory, output, os.Stdout); err != nil {
+			fatal("error rendering archive: %v", err)
+		}
+		return
+	}
+
 	if password == "" {
 		var err error
 		password, err = readPassword(passwordFile)
@@ -188,20 +329,71 @@ func main() {
 		fatal("error creating instapaper client: %v", err)
 	}
 
-	var outputWriter OutputWriter
-	switch strings.ToLower(outputFormat) {
-	case "jekyll":
-		outputWriter = jekyllOutputWriter{Directory: directory}
-	default:
-		log.Fatalf("unsupported output format: %q", outputFormat)
+	progress := newProgressReporter()
+	outputWriter, err := newOutputWriter(directory, directory, output, progress)
+	if err != nil {
+		fatal("%v", err)
 	}
 
-	queue := NewJobQueue(runtime.NumCPU())
-	queue.Start()
-	defer queue.Stop()
+	// An interrupt stops new bookmarks from being submitted, and in-flight
+	// ones are aborted if they haven't finished within shutdownTimeout.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	jobCtx, abortJobs := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopSignals() // interrupting again exits immediately
+			slog.Warn("interrupted, waiting for in-flight bookmarks to finish", "timeout", shutdownTimeout)
+			time.AfterFunc(shutdownTimeout, abortJobs)
+		case <-finished:
+		}
+	}()
+
+	queue := NewJobQueue(numWorkers)
+	queue.ReportProgress(progress)
+	queue.Start(jobCtx)
+	progress.Start(os.Stderr, progressInterval)
 
-	err = createInstapaperArchive(*apiClient, directory, exportCSVFileName, outputWriter, queue)
-	if err != nil {
+	rateLimiter := newAPIRateLimiter(apiRate, apiBurst)
+	rateLimiter.MaxAttempts = apiMaxAttempts
+	var assets *assetMirror
+	if mirrorAssets {
+		assets = newAssetMirror(directory)
+		assets.MaxSize = maxAssetSize
+	}
+	var capture *pageCapture
+	if capturePages {
+		capture = newPageCapture(directory, captureTimeout)
+		capture.MaxSize = maxPageSize
+	}
+	total, err := createInstapaperArchive(ctx, apiClient, directory, exportFileNames, exportFormat, outputWriter, assets, capture, queue, rateLimiter, progress)
+	if err != nil && !errors.Is(err, context.Canceled) {
 		fatal("error creating instapaper archive: %v", err)
 	}
+
+	failures := queue.Wait()
+	close(finished)
+	queue.Stop()
+	abortJobs()
+	progress.Stop()
+	if err := outputWriter.Close(); err != nil {
+		fatal("error closing output: %v", err)
+	}
+	if err := assets.Save(); err != nil {
+		fatal("error saving asset index: %v", err)
+	}
+	progress.PrintSummary(os.Stdout)
+	if ctx.Err() != nil {
+		succeeded := queue.Succeeded()
+		fmt.Printf("interrupted: archived %d of %d bookmark(s), %d remaining\n", succeeded, total, total-succeeded)
+		os.Exit(1)
+	}
+	if len(failures) > 0 {
+		fmt.Printf("failed to archive %d bookmark(s):\n", len(failures))
+		for _, failure := range failures {
+			fmt.Printf("  %v\n", failure)
+		}
+		os.Exit(1)
+	}
 }
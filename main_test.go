@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -18,7 +21,7 @@ const testPassword = "testPassword123"
 const testClientID = "client-id"
 const testClientSecret = "client-secret"
 
-func newTestInstapaperClient(emailAddress, password string, handler http.Handler) (*instapaper.Client, *httptest.Server, error) {
+func newTestInstapaperClient(emailAddress, password string, handler http.Handler) (*instapaperAPI, *httptest.Server, error) {
 	server := httptest.NewServer(handler)
 	apiClient := &instapaper.Client{
 		OAuthClient: oauth.Client{
@@ -33,11 +36,12 @@ func newTestInstapaperClient(emailAddress, password string, handler http.Handler
 		Password: password,
 		BaseURL:  server.URL,
 	}
-	authErr := apiClient.Authenticate()
+	api := &instapaperAPI{Client: apiClient, HTTPClient: newAPIHTTPClient()}
+	authErr := api.Authenticate()
 	if authErr != nil {
 		return nil, server, fmt.Errorf("error authenticating: %v", authErr)
 	}
-	return apiClient, server, nil
+	return api, server, nil
 }
 
 func fileContentsMatch(t *testing.T, path, expected string) {
@@ -53,3 +57,134 @@ func fileContentsMatch(t *testing.T, path, expected string) {
 		t.Fatalf("file %q does not contain %q:\n\n%s\n---", path, expected, string(contents))
 	}
 }
+
+// newTestBookmark returns a bookmark listed by the API, with the given full
+// text, for tests to adjust as they need.
+func newTestBookmark(id int, fullText string) bookmarkData {
+	return bookmarkData{
+		Bookmark: &instapaper.Bookmark{
+			Hash:  "hash" + strconv.Itoa(id),
+			ID:    id,
+			Title: "Title for the bookmark",
+			URL:   "https://example.com/bookmark" + strconv.Itoa(id),
+			Time:  1288608076,
+		},
+		FullText:         fullText,
+		TextSource:       textSourceInstapaper,
+		ContainingFolder: "Unread",
+	}
+}
+
+func newTestAPIHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "oauth_token=token&oauth_token_secret=secret")
+	})
+	return mux
+}
+
+// newTestPagingAPIHandler serves a folder of totalBookmarks bookmarks a page at
+// a time, newest first, leaving out the ones in the 'have' parameter as the
+// API does.
+func newTestPagingAPIHandler(t *testing.T, totalBookmarks int, requests *int) *http.ServeMux {
+	mux := newTestAPIHandler()
+	mux.HandleFunc("/bookmarks/list", func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("unable to parse form: %v", err)
+		}
+		have := map[string]bool{}
+		for _, id := range strings.Split(r.PostForm.Get("have"), ",") {
+			have[id] = true
+		}
+		if len(have) > haveBatchSize {
+			t.Errorf("expected at most %d IDs in 'have', got %d", haveBatchSize, len(have))
+		}
+		var resp instapaper.BookmarkListResponse
+		for id := totalBookmarks; id > 0 && len(resp.Bookmarks) < bookmarkListPageSize; id-- {
+			if have[strconv.Itoa(id)] {
+				continue
+			}
+			resp.Bookmarks = append(resp.Bookmarks, instapaper.Bookmark{
+				ID:  id,
+				URL: fmt.Sprintf("https://example.com/%d", id),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	return mux
+}
+
+func TestListBookmarksFromFolders_Paginates(t *testing.T) {
+	const totalBookmarks = 1200
+	requests := 0
+	client, server, err := newTestInstapaperClient(testEmailAddress, testPassword, newTestPagingAPIHandler(t, totalBookmarks, &requests))
+	defer server.Close()
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+
+	bookmarks := map[string]*bookmarkData{
+		"https://example.com/1": {BookmarkExportMeta: &bookmarkExportMeta{URL: "https://example.com/1"}},
+	}
+	folders := []instapaper.Folder{{ID: instapaper.FolderIDArchive, Slug: "archive"}}
+	if err := listBookmarksFromFolders(context.Background(), client, folders, bookmarks, nil); err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+
+	if len(bookmarks) != totalBookmarks {
+		t.Fatalf("expected %d bookmarks, got %d", totalBookmarks, len(bookmarks))
+	}
+	// 2 full pages, then a short one which ends the folder.
+	if requests != 3 {
+		t.Fatalf("expected 3 list requests, got %d", requests)
+	}
+	if bookmarks["https://example.com/1"].Bookmark == nil {
+		t.Fatalf("expected CSV bookmark to be merged with API data")
+	}
+}
+
+func TestListBookmarksFromFolders_BatchesHave(t *testing.T) {
+	requests := 0
+	client, server, err := newTestInstapaperClient(testEmailAddress, testPassword, newTestPagingAPIHandler(t, haveBatchSize+bookmarkListPageSize+1, &requests))
+	defer server.Close()
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+
+	// Past the first batch, each page is requested once per batch. The
+	// server always returns the newest bookmarks outside the batch, so those
+	// requests merge to nothing new, which is an error instead of a
+	// truncated folder.
+	bookmarks := map[string]*bookmarkData{}
+	folders := []instapaper.Folder{{ID: instapaper.FolderIDArchive, Slug: "archive"}}
+	err = listBookmarksFromFolders(context.Background(), client, folders, bookmarks, nil)
+	expected := fmt.Sprintf(`folder "archive" stopped returning new bookmarks after %d`, haveBatchSize+bookmarkListPageSize)
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected %q, got %v", expected, err)
+	}
+	if len(bookmarks) != haveBatchSize+bookmarkListPageSize {
+		t.Errorf("expected %d bookmarks, got %d", haveBatchSize+bookmarkListPageSize, len(bookmarks))
+	}
+	// 21 single requests, then one for each of the two batches.
+	if requests != haveBatchSize/bookmarkListPageSize+3 {
+		t.Errorf("expected %d list requests, got %d", haveBatchSize/bookmarkListPageSize+3, requests)
+	}
+}
+
+func TestHaveBatches(t *testing.T) {
+	have := make([]string, 2*haveBatchSize+1)
+	for i := range have {
+		have[i] = strconv.Itoa(i)
+	}
+	batches := haveBatches(have)
+	if len(batches) != 3 || len(batches[0]) != haveBatchSize || len(batches[1]) != haveBatchSize || len(batches[2]) != 1 {
+		t.Fatalf("expected batches of %d, %d and 1, got %d batches", haveBatchSize, haveBatchSize, len(batches))
+	}
+	if batches[2][0] != have[2*haveBatchSize] {
+		t.Errorf("expected the last batch to hold the last ID, got %v", batches[2])
+	}
+	if batches := haveBatches(nil); len(batches) != 1 || len(batches[0]) != 0 {
+		t.Errorf("expected a single empty batch without IDs, got %v", batches)
+	}
+}
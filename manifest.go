@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// syncManifestFileName is the file in the archive directory which records
+// what each bookmark looked like when it was last written.
+const syncManifestFileName = ".sync-manifest.json"
+
+type syncManifestEntry struct {
+	Hash              string
+	ProgressTimestamp int64
+	HighlightCount    int
+	Folder            string
+	FullTextHash      string
+	// PostStale is set when the post wasn't rewritten for changes to the
+	// rest of the entry, because the full text was missing, so it's
+	// rewritten once the text is back.
+	PostStale bool `json:",omitempty"`
+}
+
+// syncManifestChanges lists which archive artifacts for a bookmark are out of
+// date compared to the manifest.
+type syncManifestChanges struct {
+	Metadata   bool
+	Post       bool
+	FullText   bool
+	Highlights bool
+}
+
+var allSyncManifestChanges = syncManifestChanges{Metadata: true, Post: true, FullText: true, Highlights: true}
+
+func newSyncManifestEntry(bookmark bookmarkData) syncManifestEntry {
+	entry := syncManifestEntry{
+		Hash:           bookmark.GetHash(),
+		HighlightCount: len(bookmark.Highlights),
+		Folder:         bookmark.ContainingFolder,
+	}
+	if bookmark.Bookmark != nil {
+		entry.ProgressTimestamp = bookmark.Bookmark.ProgressTimestamp
+	}
+	if len(bookmark.FullText) > 0 {
+		// Mirroring images changes the text each format writes.
+		hash := sha256.New()
+		hash.Write([]byte(bookmark.FullText))
+		srcs := make([]string, 0, len(bookmark.Assets))
+		for src := range bookmark.Assets {
+			srcs = append(srcs, src)
+		}
+		sort.Strings(srcs)
+		for _, src := range srcs {
+			fmt.Fprintf(hash, "\x00%s\x00%s", src, bookmark.Assets[src])
+		}
+		entry.FullTextHash = hex.EncodeToString(hash.Sum(nil))
+	}
+	return entry
+}
+
+type syncManifest struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]syncManifestEntry
+}
+
+func newSyncManifest(path string) *syncManifest {
+	return &syncManifest{path: path, entries: map[string]syncManifestEntry{}}
+}
+
+// Load reads the manifest from disk. A missing manifest is not an error.
+func (m *syncManifest) Load() error {
+	if m == nil || !fileExists(m.path) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Unmarshal(data, &m.entries)
+}
+
+// Save writes the manifest to disk.
+func (m *syncManifest) Save() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, data, 0644)
+}
+
+// Changes compares the bookmark to what was last recorded for it. A nil
+// manifest reports no changes, and a bookmark it hasn't seen reports all of
+// them.
+func (m *syncManifest) Changes(bookmark bookmarkData) syncManifestChanges {
+	if m == nil {
+		return syncManifestChanges{}
+	}
+	m.mu.Lock()
+	prev, ok := m.entries[bookmark.GetID()]
+	m.mu.Unlock()
+	if !ok {
+		return allSyncManifestChanges
+	}
+	changes, _ := compareSyncManifestEntry(prev, bookmark)
+	return changes
+}
+
+// compareSyncManifestEntry returns what changed about the bookmark since
+// prev was recorded for it, and whether the post is held back because the
+// full text is missing.
+func compareSyncManifestEntry(prev syncManifestEntry, bookmark bookmarkData) (changes syncManifestChanges, postHeldBack bool) {
+	entry := newSyncManifestEntry(bookmark)
+	// A missing full text usually means we failed to fetch it this time, so
+	// don't clobber what's already archived.
+	textMissing := entry.FullTextHash == "" && prev.FullTextHash != ""
+	// Likewise, highlights which weren't fetched are missing, not deleted.
+	highlightsMissing := entry.HighlightCount == 0 && !bookmark.HighlightsFetched
+	changes = syncManifestChanges{
+		Metadata:   entry.Hash != prev.Hash || entry.ProgressTimestamp != prev.ProgressTimestamp || entry.Folder != prev.Folder,
+		FullText:   entry.FullTextHash != "" && entry.FullTextHash != prev.FullTextHash,
+		Highlights: !highlightsMissing && entry.HighlightCount != prev.HighlightCount,
+	}
+	// Posts' front matter includes the metadata and highlight count.
+	post := prev.PostStale || changes.FullText || changes.Metadata || changes.Highlights
+	changes.Post = post && !textMissing
+	return changes, post && textMissing
+}
+
+// Update records the bookmark as it was just written.
+func (m *syncManifest) Update(bookmark bookmarkData) {
+	if m == nil {
+		return
+	}
+	entry := newSyncManifestEntry(bookmark)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if prev, ok := m.entries[bookmark.GetID()]; ok {
+		// The post wasn't written with the rest, so remember it's behind.
+		_, entry.PostStale = compareSyncManifestEntry(prev, bookmark)
+		if entry.FullTextHash == "" {
+			entry.FullTextHash = prev.FullTextHash
+		}
+		if entry.HighlightCount == 0 && !bookmark.HighlightsFetched {
+			entry.HighlightCount = prev.HighlightCount
+		}
+	}
+	m.entries[bookmark.GetID()] = entry
+}
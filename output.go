@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// outputOptions describe the archive to write.
+type outputOptions struct {
+	// Format is a comma-separated list of jekyll, markdown, hugo, html,
+	// epub, warc or sqlite.
+	Format string
+	// Force rewrites every file, regardless of the sync manifest.
+	Force bool
+	// JekyllTemplate is the path of a text/template for Jekyll posts. If
+	// empty, defaultJekyllPostTemplate is used.
+	JekyllTemplate string
+	// JekyllPostExtension is the extension of Jekyll posts.
+	JekyllPostExtension string
+	// HugoFrontMatter is the front matter format of Hugo pages.
+	HugoFrontMatter string
+	// EPUBGroup is how bookmarks are grouped into EPUBs.
+	EPUBGroup string
+	// WARCMaxSize is the size at which to start a new WARC file.
+	WARCMaxSize int64
+}
+
+func (o *outputOptions) RegisterFlags(flags *flag.FlagSet) {
+	o.Format = "jekyll"
+	flags.Var(&formatListFlag{formats: &o.Format}, "format", "Archive `formats` (jekyll, markdown, hugo, html, epub, warc or sqlite); separate with commas or repeat for several")
+	flags.BoolVar(&o.Force, "force", false, "Rewrite every file in the archive, ignoring the sync manifest")
+	flags.StringVar(&o.JekyllTemplate, "jekyll-template", "", "The text/template file to render Jekyll posts with (defaults to the built-in template)")
+	flags.StringVar(&o.JekyllPostExtension, "jekyll-post-ext", "html", "File extension for Jekyll posts, e.g. html or md")
+	flags.StringVar(&o.EPUBGroup, "epub-group", epubGroupFolder, "How to group bookmarks into EPUBs (folder, month or year)")
+	flags.StringVar(&o.HugoFrontMatter, "hugo-front-matter", hugoFrontMatterTOML, "Front matter format for Hugo pages (toml or yaml)")
+	flags.Int64Var(&o.WARCMaxSize, "warc-max-size", defaultWARCMaxSize, "Size at which to start a new WARC file, in bytes")
+}
+
+// formatListFlag is -format, which takes a comma-separated list of
+// formats and can be given more than once. The first use replaces the
+// default.
+type formatListFlag struct {
+	formats *string
+	set     bool
+}
+
+func (f *formatListFlag) String() string {
+	if f.formats == nil {
+		return ""
+	}
+	return *f.formats
+}
+
+func (f *formatListFlag) Set(value string) error {
+	if !f.set {
+		*f.formats, f.set = value, true
+		return nil
+	}
+	*f.formats += "," + value
+	return nil
+}
+
+// Formats returns the formats to write, in order.
+func (o outputOptions) Formats() ([]string, error) {
+	var formats []string
+	seen := map[string]bool{}
+	for _, format := range strings.Split(o.Format, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		if seen[format] {
+			return nil, fmt.Errorf("output format %q given more than once", format)
+		}
+		seen[format] = true
+		formats = append(formats, format)
+	}
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("no output format given")
+	}
+	return formats, nil
+}
+
+// newOutputWriter returns a writer for the archive in archiveDirectory,
+// writing into outputDirectory. With several formats, each is written into
+// a directory of its own within outputDirectory, named after the format.
+func newOutputWriter(archiveDirectory, outputDirectory string, options outputOptions, progress *progressReporter) (OutputWriter, error) {
+	formats, err := options.Formats()
+	if err != nil {
+		return nil, err
+	}
+	if len(formats) == 1 {
+		return newFormatOutputWriter(formats[0], archiveDirectory, outputDirectory, options, progress)
+	}
+	fanOut := &fanOutOutputWriter{Progress: progress}
+	for _, format := range formats {
+		// The fan-out reports each bookmark once, with the files written
+		// across every format.
+		writer, err := newFormatOutputWriter(format, archiveDirectory, filepath.Join(outputDirectory, format), options, nil)
+		if err != nil {
+			return nil, err
+		}
+		fanOut.Outputs = append(fanOut.Outputs, &fanOutOutput{Format: format, Writer: writer})
+	}
+	return fanOut, nil
+}
+
+// newFormatOutputWriter returns a writer for a single format.
+func newFormatOutputWriter(format, archiveDirectory, directory string, options outputOptions, progress *progressReporter) (OutputWriter, error) {
+	switch format {
+	case "jekyll":
+		postTemplate, err := parseJekyllPostTemplate(options.JekyllTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Jekyll template: %v", err)
+		}
+		baseURL, err := jekyllBaseURL(directory)
+		if err != nil {
+			return nil, err
+		}
+		return jekyllOutputWriter{
+			Directory:        directory,
+			ArchiveDirectory: archiveDirectory,
+			BaseURL:          baseURL,
+			Force:            options.Force,
+			Manifest:         newSyncManifest(filepath.Join(directory, syncManifestFileName)),
+			Progress:         progress,
+			PostTemplate:     postTemplate,
+			PostExtension:    options.JekyllPostExtension,
+		}, nil
+	case "markdown":
+		return markdownOutputWriter{
+			Directory:        directory,
+			ArchiveDirectory: archiveDirectory,
+			Force:            options.Force,
+			Manifest:         newSyncManifest(filepath.Join(directory, syncManifestFileName)),
+			Progress:         progress,
+		}, nil
+	case "hugo":
+		return hugoOutputWriter{
+			Directory:        directory,
+			ArchiveDirectory: archiveDirectory,
+			FrontMatter:      strings.ToLower(options.HugoFrontMatter),
+			Force:            options.Force,
+			Manifest:         newSyncManifest(filepath.Join(directory, syncManifestFileName)),
+			Progress:         progress,
+		}, nil
+	case "html":
+		return &htmlSiteOutputWriter{
+			Directory:        directory,
+			ArchiveDirectory: archiveDirectory,
+			Force:            options.Force,
+			Manifest:         newSyncManifest(filepath.Join(directory, syncManifestFileName)),
+			Progress:         progress,
+		}, nil
+	case "epub":
+		return &epubOutputWriter{
+			Directory:        directory,
+			ArchiveDirectory: archiveDirectory,
+			Group:            strings.ToLower(options.EPUBGroup),
+			Force:            options.Force,
+			Manifest:         newSyncManifest(filepath.Join(directory, syncManifestFileName)),
+			Progress:         progress,
+		}, nil
+	case "warc":
+		return &warcOutputWriter{
+			Directory:        directory,
+			ArchiveDirectory: archiveDirectory,
+			MaxSize:          options.WARCMaxSize,
+			Force:            options.Force,
+			Manifest:         newSyncManifest(filepath.Join(directory, syncManifestFileName)),
+			Progress:         progress,
+		}, nil
+	case "sqlite":
+		return &sqliteOutputWriter{Path: filepath.Join(directory, "instapaper.db")}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format: %q", format)
+	}
+}
+
+// removeDeletedHighlights removes the highlights file at path once the
+// bookmark's highlights have been fetched and there are none left.
+func removeDeletedHighlights(path string, bookmark bookmarkData) error {
+	if !bookmark.HighlightsFetched {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// slugify returns s for use in a path: lowercased, with runs of anything but
+// letters and digits replaced by hyphens.
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// How bookmarks are grouped into EPUBs, for -epub-group.
+const (
+	epubGroupFolder = "folder"
+	epubGroupMonth  = "month"
+	epubGroupYear   = "year"
+)
+
+// epubStagingDirName holds each bookmark's chapter between runs, so every
+// EPUB includes bookmarks archived by previous runs too.
+const epubStagingDirName = ".epub"
+
+// epubChapter is a staged chapter. Images are the archive-relative paths of
+// the mirrored images it embeds.
+type epubChapter struct {
+	ID     string
+	Title  string
+	URL    string
+	Folder string
+	Date   string
+	Saved  int64
+	Images []string `json:",omitempty"`
+}
+
+// epubOutputWriter writes one EPUB 3 book per folder, month or year, with a
+// chapter per bookmark. Chapters are staged as they come in, and the books
+// are assembled by Close.
+type epubOutputWriter struct {
+	Directory string
+	// ArchiveDirectory is where mirrored images are embedded from. If
+	// empty, it's Directory.
+	ArchiveDirectory string
+	// Group is how bookmarks are grouped into books: folder, month or year.
+	// If empty, they're grouped by folder.
+	Group string
+	// Force rewrites every chapter, regardless of what the manifest says.
+	Force bool
+	// Manifest records what was last written for each bookmark so only the
+	// chapters whose inputs changed are rewritten. If nil, existing
+	// chapters are never rewritten.
+	Manifest *syncManifest
+	// Progress is told how many files were written for each bookmark.
+	Progress *progressReporter
+
+	mu       sync.Mutex
+	chapters map[string]epubChapter
+}
+
+func (w *epubOutputWriter) archiveDir() string {
+	if w.ArchiveDirectory != "" {
+		return w.ArchiveDirectory
+	}
+	return w.Directory
+}
+
+func (w *epubOutputWriter) stagingDir() string {
+	return filepath.Join(w.Directory, epubStagingDirName)
+}
+
+func (w *epubOutputWriter) Preflight() error {
+	switch w.Group {
+	case "", epubGroupFolder, epubGroupMonth, epubGroupYear:
+	default:
+		return fmt.Errorf("unsupported EPUB grouping: %q", w.Group)
+	}
+	for _, dir := range []string{w.Directory, filepath.Join(w.stagingDir(), "chapters")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := removeAtomicWriteTempFiles(dir); err != nil {
+			return err
+		}
+	}
+	w.chapters = map[string]epubChapter{}
+	if indexPath := filepath.Join(w.stagingDir(), "index.json"); fileExists(indexPath) {
+		data, err := ioutil.ReadFile(indexPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &w.chapters); err != nil {
+			return fmt.Errorf("error reading %s: %v", indexPath, err)
+		}
+	}
+	return w.Manifest.Load()
+}
+
+func (w *epubOutputWriter) Write(bookmark bookmarkData) error {
+	files, err := w.writeFiles(bookmark)
+	if err != nil {
+		return err
+	}
+	w.Progress.BookmarkWritten(files)
+	return nil
+}
+
+// writeFiles writes the bookmark, returning how many files it wrote.
+func (w *epubOutputWriter) writeFiles(bookmark bookmarkData) (int, error) {
+	changes := w.Manifest.Changes(bookmark)
+	data := newPostData(bookmark)
+	chapter := epubChapter{
+		ID:     data.ID,
+		Title:  data.Title,
+		URL:    data.URL,
+		Folder: data.Folder,
+		Date:   bookmark.GetYYYYMMDD(),
+		Saved:  data.Saved.Unix(),
+	}
+	if data.Saved.IsZero() {
+		chapter.Saved = data.Date.Unix()
+	}
+
+	chapterPath := filepath.Join(w.stagingDir(), "chapters", chapter.ID+".xhtml")
+	written := false
+	if w.Force || changes.Post || !fileExists(chapterPath) {
+		// Mirrored images are embedded from the archive's _assets.
+		fullText, err := rewriteAssetLinks(bookmark.FullText, bookmark.Assets, assetsDirName+"/")
+		if err != nil {
+			slog.Error("error rendering EPUB chapter", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+			return 0, err
+		}
+		bookmark.FullText = fullText
+		xhtml, images, err := renderEPUBChapter(bookmark, w.archiveDir())
+		if err != nil {
+			slog.Error("error rendering EPUB chapter", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+			return 0, err
+		}
+		if err := writeFileAtomic(chapterPath, xhtml, 0644); err != nil {
+			slog.Error("error writing EPUB chapter", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+			return 0, err
+		}
+		chapter.Images = images
+		written = true
+	}
+
+	w.mu.Lock()
+	if prev, ok := w.chapters[chapter.ID]; ok && !written {
+		chapter.Images = prev.Images
+	}
+	w.chapters[chapter.ID] = chapter
+	w.mu.Unlock()
+
+	w.Manifest.Update(bookmark)
+	filesWritten := 0
+	if written {
+		filesWritten = 1
+	}
+	return filesWritten, nil
+}
+
+// Close assembles a book for each group of bookmarks archived so far.
+func (w *epubOutputWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.chapters == nil {
+		return nil
+	}
+
+	groups := map[string][]epubChapter{}
+	for _, chapter := range w.chapters {
+		group := w.groupOf(chapter)
+		groups[group] = append(groups[group], chapter)
+	}
+	names := epubBookNames(groups)
+	for group, chapters := range groups {
+		sort.Slice(chapters, func(i, j int) bool {
+			if chapters[i].Saved != chapters[j].Saved {
+				return chapters[i].Saved < chapters[j].Saved
+			}
+			return chapters[i].ID < chapters[j].ID
+		})
+		bookPath := filepath.Join(w.Directory, names[group]+".epub")
+		err := writeFileAtomicFunc(bookPath, 0644, func(out io.Writer) error {
+			return w.writeBook(out, group, names[group], chapters)
+		})
+		if err != nil {
+			return fmt.Errorf("error writing %s: %v", bookPath, err)
+		}
+	}
+
+	index, err := json.Marshal(w.chapters)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(w.stagingDir(), "index.json"), index, 0644); err != nil {
+		return err
+	}
+	return w.Manifest.Save()
+}
+
+// epubBookNames names each group's book after its slug. Groups whose slugs
+// are the same, like "Books!" and "books", are told apart by a numeric
+// suffix, given in the order of their names.
+func epubBookNames(groups map[string][]epubChapter) map[string]string {
+	sorted := make([]string, 0, len(groups))
+	for group := range groups {
+		sorted = append(sorted, group)
+	}
+	sort.Strings(sorted)
+
+	// The first group with each slug keeps it, so a folder named like
+	// "books-2" keeps its own name, then the rest take the first free suffix.
+	names := map[string]string{}
+	taken := map[string]bool{}
+	for _, group := range sorted {
+		if name := slugify(group); !taken[name] {
+			names[group] = name
+			taken[name] = true
+		}
+	}
+	for _, group := range sorted {
+		if _, ok := names[group]; ok {
+			continue
+		}
+		for i := 2; ; i++ {
+			if name := fmt.Sprintf("%s-%d", slugify(group), i); !taken[name] {
+				names[group] = name
+				taken[name] = true
+				break
+			}
+		}
+	}
+	return names
+}
+
+func (w *epubOutputWriter) groupOf(chapter epubChapter) string {
+	switch w.Group {
+	case epubGroupMonth:
+		return chapter.Date[:7]
+	case epubGroupYear:
+		return chapter.Date[:4]
+	}
+	if slugify(chapter.Folder) == "" {
+		return "Unfiled"
+	}
+	return chapter.Folder
+}
+
+const epubContainerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubStyleCSS = `body { font-family: serif; line-height: 1.4; }
+.meta { font-size: 0.9em; color: #555; }
+mark { background: #fff3a0; }
+.highlights blockquote { margin-left: 1em; border-left: 3px solid #f0c000; padding-left: 0.5em; }
+.note { font-style: italic; }
+img { max-width: 100%; }
+`
+
+// epubMediaTypes are the image types an EPUB can embed.
+var epubMediaTypes = map[string]string{
+	".gif":  "image/gif",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".webp": "image/webp",
+}
+
+// writeBook writes the EPUB for a group of chapters, named name, to out.
+func (w *epubOutputWriter) writeBook(out io.Writer, group, name string, chapters []epubChapter) error {
+	zw := zip.NewWriter(out)
+
+	// The mimetype must come first, uncompressed and without extra fields.
+	mimetype := []byte("application/epub+zip")
+	f, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "mimetype",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(mimetype),
+		CompressedSize64:   uint64(len(mimetype)),
+		UncompressedSize64: uint64(len(mimetype)),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(mimetype); err != nil {
+		return err
+	}
+	create := func(name string, data []byte) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	if err := create("META-INF/container.xml", []byte(epubContainerXML)); err != nil {
+		return err
+	}
+	if err := create("OEBPS/style.css", []byte(epubStyleCSS)); err != nil {
+		return err
+	}
+
+	var manifest, spine, toc bytes.Buffer
+	images := map[string]bool{}
+	for i, chapter := range chapters {
+		data, err := ioutil.ReadFile(filepath.Join(w.stagingDir(), "chapters", chapter.ID+".xhtml"))
+		if err != nil {
+			return err
+		}
+		href := "chapters/" + chapter.ID + ".xhtml"
+		if err := create("OEBPS/"+href, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "    <item id=\"chapter-%d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, href)
+		fmt.Fprintf(&spine, "    <itemref idref=\"chapter-%d\"/>\n", i+1)
+		fmt.Fprintf(&toc, "      <li><a href=\"%s\">%s</a></li>\n", href, html.EscapeString(chapter.Title))
+
+		for _, image := range chapter.Images {
+			name := epubImageName(image)
+			if images[name] {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(w.archiveDir(), filepath.FromSlash(image)))
+			if err != nil {
+				return err
+			}
+			if err := create("OEBPS/images/"+name, data); err != nil {
+				return err
+			}
+			images[name] = true
+			fmt.Fprintf(&manifest, "    <item id=\"image-%d\" href=\"images/%s\" media-type=\"%s\"/>\n",
+				len(images), name, epubMediaTypes[strings.ToLower(path.Ext(name))])
+		}
+	}
+
+	title := html.EscapeString("Instapaper: " + group)
+	nav := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en" xml:lang="en">
+<head>
+  <meta charset="UTF-8"/>
+  <title>` + title + `</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>` + title + `</h1>
+    <ol>
+` + toc.String() + `    </ol>
+  </nav>
+</body>
+</html>
+`
+	if err := create("OEBPS/nav.xhtml", []byte(nav)); err != nil {
+		return err
+	}
+
+	opf := `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="en">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">urn:instapaper-archive:` + html.EscapeString(name) + `</dc:identifier>
+    <dc:title>` + title + `</dc:title>
+    <dc:language>en</dc:language>
+    <dc:creator>instapaper-archive</dc:creator>
+    <meta property="dcterms:modified">` + time.Now().UTC().Format("2006-01-02T15:04:05Z") + `</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+` + manifest.String() + `  </manifest>
+  <spine>
+    <itemref idref="nav"/>
+` + spine.String() + `  </spine>
+</package>
+`
+	if err := create("OEBPS/content.opf", []byte(opf)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// epubImageName names an embedded image after its path in the archive.
+func epubImageName(image string) string {
+	hash := sha256.Sum256([]byte(image))
+	return hex.EncodeToString(hash[:8]) + strings.ToLower(path.Ext(image))
+}
+
+// epubElements are the elements kept in chapters. Anything else is replaced
+// by its contents, so chapters stay valid XHTML.
+var epubElements = map[atom.Atom]bool{
+	atom.A: true, atom.Abbr: true, atom.Article: true, atom.Aside: true, atom.B: true,
+	atom.Blockquote: true, atom.Br: true, atom.Caption: true, atom.Cite: true, atom.Code: true,
+	atom.Dd: true, atom.Del: true, atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Em: true,
+	atom.Figcaption: true, atom.Figure: true, atom.H1: true, atom.H2: true, atom.H3: true,
+	atom.H4: true, atom.H5: true, atom.H6: true, atom.Hr: true, atom.I: true, atom.Img: true,
+	atom.Ins: true, atom.Kbd: true, atom.Li: true, atom.Mark: true, atom.Ol: true, atom.P: true,
+	atom.Pre: true, atom.Q: true, atom.S: true, atom.Samp: true, atom.Section: true,
+	atom.Small: true, atom.Span: true, atom.Strong: true, atom.Sub: true, atom.Sup: true,
+	atom.Table: true, atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true,
+	atom.Thead: true, atom.Time: true, atom.Tr: true, atom.U: true, atom.Ul: true, atom.Var: true,
+}
+
+// epubAttributes are the attributes kept in chapters.
+var epubAttributes = map[string]bool{
+	"alt": true, "colspan": true, "href": true, "rowspan": true, "src": true, "title": true,
+}
+
+// xmlInvalidChars are characters which can't appear in XML.
+var xmlInvalidChars = regexp.MustCompile(`[\x00-\x08\x0B\x0C\x0E-\x1F\x{FFFE}\x{FFFF}]`)
+
+// renderEPUBChapter renders a bookmark as an XHTML chapter, with its
+// highlights marked in the text and listed at the end. Images mirrored into
+// archiveDirectory are referenced from ../images/ and their paths returned;
+// any others are replaced by their alt text.
+func renderEPUBChapter(bookmark bookmarkData, archiveDirectory string) ([]byte, []string, error) {
+	data := newPostData(bookmark)
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en" xml:lang="en">
+<head>
+<meta charset="UTF-8"/>
+<title>` + xmlEscape(data.Title) + `</title>
+<link rel="stylesheet" type="text/css" href="../style.css"/>
+</head>
+<body>
+<section epub:type="chapter">
+<h1>` + xmlEscape(data.Title) + `</h1>
+<p class="meta"><a href="` + xmlEscape(data.URL) + `">` + xmlEscape(data.URL) + `</a><br/>Saved ` + bookmark.GetYYYYMMDD())
+	if data.Folder != "" {
+		buf.WriteString(" in " + xmlEscape(data.Folder))
+	}
+	buf.WriteString("</p>\n")
+
+	var images []string
+	if len(data.FullText) > 0 {
+		sanitized, err := sanitizeHTML(data.FullText)
+		if err != nil {
+			return nil, nil, err
+		}
+		body := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+		nodes, err := html.ParseFragment(strings.NewReader(sanitized), body)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, n := range nodes {
+			body.AppendChild(n)
+		}
+		images = epubCleanNode(body, archiveDirectory)
+		for _, highlight := range data.Highlights {
+			markHighlight(body, strings.TrimSpace(highlight.Text))
+		}
+		for c := body.FirstChild; c != nil; c = c.NextSibling {
+			if err := html.Render(&buf, c); err != nil {
+				return nil, nil, err
+			}
+		}
+		buf.WriteString("\n")
+	}
+
+	if len(data.Highlights) > 0 {
+		buf.WriteString("<section class=\"highlights\">\n<h2>Highlights</h2>\n")
+		for _, highlight := range data.Highlights {
+			buf.WriteString("<blockquote><p><mark>" + xmlEscape(strings.TrimSpace(highlight.Text)) + "</mark></p>")
+			if note := strings.TrimSpace(highlight.Note); note != "" {
+				buf.WriteString("<p class=\"note\">" + xmlEscape(note) + "</p>")
+			}
+			buf.WriteString("</blockquote>\n")
+		}
+		buf.WriteString("</section>\n")
+	}
+	buf.WriteString("</section>\n</body>\n</html>\n")
+	return buf.Bytes(), images, nil
+}
+
+func xmlEscape(s string) string {
+	return html.EscapeString(xmlInvalidChars.ReplaceAllString(s, ""))
+}
+
+// epubCleanNode strips n's descendants down to epubElements and
+// epubAttributes, and returns the mirrored images they reference.
+func epubCleanNode(n *html.Node, archiveDirectory string) []string {
+	var images []string
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.TextNode:
+			c.Data = xmlInvalidChars.ReplaceAllString(c.Data, "")
+		case html.ElementNode:
+			images = append(images, epubCleanNode(c, archiveDirectory)...)
+			attrs := c.Attr[:0]
+			for _, attr := range c.Attr {
+				if attr.Key == "href" && !epubExternalLink(attr.Val) {
+					// Relative links have nowhere to go in the book.
+					continue
+				}
+				if attr.Namespace == "" && epubAttributes[attr.Key] {
+					attr.Val = xmlInvalidChars.ReplaceAllString(attr.Val, "")
+					attrs = append(attrs, attr)
+				}
+			}
+			c.Attr = attrs
+			if !epubElements[c.DataAtom] || (c.DataAtom == atom.A && len(c.Attr) == 0) {
+				for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+					c.RemoveChild(gc)
+					n.InsertBefore(gc, c)
+				}
+				n.RemoveChild(c)
+				break
+			}
+			if c.DataAtom == atom.Img {
+				if image, ok := epubLocalImage(c, archiveDirectory); ok {
+					images = append(images, image)
+				} else {
+					n.InsertBefore(&html.Node{Type: html.TextNode, Data: markdownAttr(c, "alt")}, c)
+					n.RemoveChild(c)
+				}
+			}
+		default:
+			n.RemoveChild(c)
+		}
+		c = next
+	}
+	return images
+}
+
+func epubExternalLink(href string) bool {
+	u, err := url.Parse(href)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "mailto")
+}
+
+// epubLocalImage points img at its copy in the book, if it refers to a
+// supported image in the archive.
+func epubLocalImage(img *html.Node, archiveDirectory string) (string, bool) {
+	var src *html.Attribute
+	hasAlt := false
+	for i := range img.Attr {
+		switch img.Attr[i].Key {
+		case "src":
+			src = &img.Attr[i]
+		case "alt":
+			hasAlt = true
+		}
+	}
+	if src == nil {
+		return "", false
+	}
+	u, err := url.Parse(src.Val)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+	image := strings.TrimPrefix(path.Clean("/"+u.Path), "/")
+	if epubMediaTypes[strings.ToLower(path.Ext(image))] == "" {
+		return "", false
+	}
+	if info, err := os.Stat(filepath.Join(archiveDirectory, filepath.FromSlash(image))); err != nil || info.IsDir() {
+		return "", false
+	}
+	src.Val = "../images/" + epubImageName(image)
+	if !hasAlt {
+		img.Attr = append(img.Attr, html.Attribute{Key: "alt"})
+	}
+	return image, true
+}
+
+// markHighlight wraps the first occurrence of text in a <mark>, if it's
+// within a single text node.
+func markHighlight(n *html.Node, text string) bool {
+	if text == "" {
+		return false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			if markHighlight(c, text) {
+				return true
+			}
+			continue
+		}
+		if c.Type != html.TextNode {
+			continue
+		}
+		i := strings.Index(c.Data, text)
+		if i < 0 {
+			continue
+		}
+		after := c.Data[i+len(text):]
+		c.Data = c.Data[:i]
+		mark := &html.Node{Type: html.ElementNode, Data: "mark", DataAtom: atom.Mark}
+		mark.AppendChild(&html.Node{Type: html.TextNode, Data: text})
+		n.InsertBefore(mark, c.NextSibling)
+		if after != "" {
+			n.InsertBefore(&html.Node{Type: html.TextNode, Data: after}, mark.NextSibling)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var epubOutputWriterTestDir = filepath.Join("tmp", "epubOutputWriter")
+
+// epubPackage is the part of content.opf checkEPUB looks at.
+type epubPackage struct {
+	Version          string `xml:"version,attr"`
+	UniqueIdentifier string `xml:"unique-identifier,attr"`
+	Metadata         struct {
+		Identifiers []struct {
+			ID    string `xml:"id,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"identifier"`
+		Titles    []string `xml:"title"`
+		Languages []string `xml:"language"`
+		Metas     []struct {
+			Property string `xml:"property,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// checkEPUB checks the structure of an EPUB 3 book, and returns its files.
+func checkEPUB(t *testing.T, bookPath string) map[string]string {
+	t.Helper()
+	data, err := ioutil.ReadFile(bookPath)
+	if err != nil {
+		t.Fatalf("unable to read book: %v", err)
+	}
+	// The mimetype must be the first file, stored uncompressed without
+	// extra fields, so it can be found at a fixed offset.
+	if len(data) < 58 || string(data[30:38]) != "mimetype" || string(data[38:58]) != "application/epub+zip" {
+		t.Errorf("mimetype is not the first file, stored uncompressed")
+	}
+	if binary.LittleEndian.Uint16(data[28:30]) != 0 {
+		t.Errorf("mimetype has extra fields")
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("book is not a zip: %v", err)
+	}
+	if r.File[0].Name != "mimetype" || r.File[0].Method != zip.Store {
+		t.Errorf("expected mimetype to be stored first, got %q", r.File[0].Name)
+	}
+	files := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", f.Name, err)
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", f.Name, err)
+		}
+		files[f.Name] = string(contents)
+	}
+
+	var container struct {
+		Rootfiles []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	checkXML(t, "META-INF/container.xml", files["META-INF/container.xml"], &container)
+	if len(container.Rootfiles) != 1 || container.Rootfiles[0].MediaType != "application/oebps-package+xml" {
+		t.Fatalf("expected one package in container.xml, got %+v", container.Rootfiles)
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	var pkg epubPackage
+	checkXML(t, opfPath, files[opfPath], &pkg)
+
+	if pkg.Version != "3.0" {
+		t.Errorf("expected EPUB version 3.0, got %q", pkg.Version)
+	}
+	identified := false
+	for _, identifier := range pkg.Metadata.Identifiers {
+		identified = identified || (identifier.ID == pkg.UniqueIdentifier && identifier.Value != "")
+	}
+	if !identified {
+		t.Errorf("no dc:identifier matches unique-identifier %q", pkg.UniqueIdentifier)
+	}
+	if len(pkg.Metadata.Titles) == 0 || len(pkg.Metadata.Languages) == 0 {
+		t.Errorf("expected a dc:title and dc:language")
+	}
+	modified := false
+	for _, meta := range pkg.Metadata.Metas {
+		modified = modified || (meta.Property == "dcterms:modified" && len(meta.Value) == len("2006-01-02T15:04:05Z"))
+	}
+	if !modified {
+		t.Errorf("expected dcterms:modified")
+	}
+
+	base := path.Dir(opfPath)
+	ids := map[string]bool{}
+	nav := ""
+	for _, item := range pkg.Manifest {
+		ids[item.ID] = true
+		href := path.Join(base, item.Href)
+		contents, ok := files[href]
+		if !ok {
+			t.Errorf("manifest item %q is missing from the book", href)
+			continue
+		}
+		if item.MediaType == "application/xhtml+xml" {
+			checkXML(t, href, contents, nil)
+			if !strings.Contains(contents, `xmlns="http://www.w3.org/1999/xhtml"`) {
+				t.Errorf("%s is not in the XHTML namespace", href)
+			}
+		}
+		if item.Properties == "nav" {
+			nav = href
+		}
+	}
+	for name := range files {
+		if name == "mimetype" || name == opfPath || strings.HasPrefix(name, "META-INF/") {
+			continue
+		}
+		found := false
+		for _, item := range pkg.Manifest {
+			found = found || path.Join(base, item.Href) == name
+		}
+		if !found {
+			t.Errorf("%s is not in the manifest", name)
+		}
+	}
+	if nav == "" {
+		t.Fatalf("no nav document in the manifest")
+	}
+	if len(pkg.Spine) == 0 {
+		t.Errorf("spine is empty")
+	}
+	for _, itemref := range pkg.Spine {
+		if !ids[itemref.IDRef] {
+			t.Errorf("spine refers to unknown item %q", itemref.IDRef)
+		}
+	}
+	if !strings.Contains(files[nav], `epub:type="toc"`) {
+		t.Errorf("nav document has no table of contents")
+	}
+	return files
+}
+
+// checkXML checks that contents is well-formed XML, without HTML entities,
+// and decodes it into v if it isn't nil.
+func checkXML(t *testing.T, name, contents string, v interface{}) {
+	t.Helper()
+	decoder := xml.NewDecoder(strings.NewReader(contents))
+	decoder.Strict = true
+	if v != nil {
+		if err := decoder.Decode(v); err != nil {
+			t.Fatalf("%s is not valid XML: %v", name, err)
+		}
+		return
+	}
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s is not valid XML: %v\n%s", name, err, contents)
+		}
+	}
+}
+
+func TestEPUBOutputWriter_Write(t *testing.T) {
+	w := &epubOutputWriter{Directory: epubOutputWriterTestDir}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(epubOutputWriterTestDir)
+
+	// An image mirrored into the archive.
+	if err := os.MkdirAll(filepath.Join(w.Directory, "_assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.Directory, "_assets", "image.png"), []byte("not really a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bookmarks := []bookmarkData{
+		{
+			Bookmark: &instapaper.Bookmark{ID: 1, Title: "First & <best>", URL: "https://example.com/1?a=b&c=d", Time: 1288608076},
+			FullText: `<html><body><h1>Heading</h1><p>Some text&nbsp;to highlight here.<br>Line two</p>` +
+				`<center>Unwrapped</center><img src="https://example.com/image.png"><img src="https://example.com/remote.png" alt="Remote">` +
+				`<p style="color: red" id="x:y">Styled <a href="/relative">link</a></p><!-- comment --></body></html>`,
+			Assets:           map[string]string{"https://example.com/image.png": "image.png"},
+			Highlights:       []instapaper.Highlight{{Text: "to highlight", Note: "A note"}},
+			ContainingFolder: "Books To Read",
+		},
+		{
+			Bookmark:         &instapaper.Bookmark{ID: 2, Title: "Second", URL: "https://example.com/2", Time: 1288694476},
+			ContainingFolder: "Books To Read",
+		},
+		{
+			BookmarkExportMeta: &bookmarkExportMeta{URL: "https://example.com/3", Title: "Unfiled", Timestamp: "1288608076"},
+		},
+	}
+	for _, bookmark := range bookmarks {
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	files := checkEPUB(t, filepath.Join(w.Directory, "books-to-read.epub"))
+	checkEPUB(t, filepath.Join(w.Directory, "unfiled.epub"))
+
+	chapter := files["OEBPS/chapters/1.xhtml"]
+	for _, expected := range []string{
+		"<title>First &amp; &lt;best&gt;</title>",
+		`<a href="https://example.com/1?a=b&amp;c=d">`,
+		"Some text\u00a0<mark>to highlight</mark> here.<br/>Line two",
+		"Unwrapped",
+		`<img src="../images/`,
+		"Remote",
+		"<p>Styled link</p>",
+		`<blockquote><p><mark>to highlight</mark></p><p class="note">A note</p></blockquote>`,
+	} {
+		if !strings.Contains(chapter, expected) {
+			t.Errorf("expected chapter to contain %q:\n%s", expected, chapter)
+		}
+	}
+	for _, unexpected := range []string{"<center", "remote.png", "style=", "comment"} {
+		if strings.Contains(chapter, unexpected) {
+			t.Errorf("expected chapter not to contain %q", unexpected)
+		}
+	}
+	images := 0
+	for name, contents := range files {
+		if strings.HasPrefix(name, "OEBPS/images/") && contents == "not really a png" {
+			images++
+		}
+	}
+	if images != 1 {
+		t.Errorf("expected the mirrored image to be embedded once, got %d", images)
+	}
+
+	nav := files["OEBPS/nav.xhtml"]
+	first, second := strings.Index(nav, "First &amp; &lt;best&gt;"), strings.Index(nav, ">Second<")
+	if first < 0 || second < 0 || first > second {
+		t.Errorf("expected the table of contents to list both bookmarks, oldest first:\n%s", nav)
+	}
+}
+
+func TestEPUBOutputWriter_GroupByMonth(t *testing.T) {
+	w := &epubOutputWriter{Directory: epubOutputWriterTestDir, Group: epubGroupMonth}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(epubOutputWriterTestDir)
+	if err := w.Write(bookmarkData{Bookmark: &instapaper.Bookmark{ID: 1, Title: "One", Time: 1288608076}}); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	checkEPUB(t, filepath.Join(w.Directory, "2010-11.epub"))
+}
+
+func TestEPUBOutputWriter_FolderNamesCollide(t *testing.T) {
+	w := &epubOutputWriter{Directory: epubOutputWriterTestDir}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(epubOutputWriterTestDir)
+	for i, folder := range []string{"Books!", "books", "books-2"} {
+		bookmark := bookmarkData{
+			Bookmark:         &instapaper.Bookmark{ID: i + 1, Title: "In " + folder, Time: 1288608076},
+			ContainingFolder: folder,
+		}
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// Each folder gets its own book, and one named like a suffixed book keeps
+	// its name.
+	for name, title := range map[string]string{
+		"books.epub":   "In Books!",
+		"books-2.epub": "In books-2",
+		"books-3.epub": "In books",
+	} {
+		nav := checkEPUB(t, filepath.Join(w.Directory, name))["OEBPS/nav.xhtml"]
+		if !strings.Contains(nav, ">"+title+"<") {
+			t.Errorf("expected %s to hold %q:\n%s", name, title, nav)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// fileCountingOutputWriter is an OutputWriter which can write a bookmark
+// without reporting it, returning how many files it wrote instead.
+type fileCountingOutputWriter interface {
+	writeFiles(bookmarkData) (int, error)
+}
+
+// fanOutOutput is one of the writers a fanOutOutputWriter writes to.
+type fanOutOutput struct {
+	Format string
+	Writer OutputWriter
+
+	// preflightErr disables the writer if it couldn't be prepared.
+	preflightErr error
+	failures     int64
+}
+
+// write writes the bookmark to the output, returning how many files it
+// wrote. Writers which can't count their files are reported as writing
+// none.
+func (o *fanOutOutput) write(bookmark bookmarkData) (int, error) {
+	if writer, ok := o.Writer.(fileCountingOutputWriter); ok {
+		return writer.writeFiles(bookmark)
+	}
+	return 0, o.Writer.Write(bookmark)
+}
+
+// fanOutOutputWriter writes every bookmark to several writers, e.g. one per
+// format. A writer which fails doesn't stop the others: bookmarks are still
+// written to them, and each writer's failures are counted separately.
+type fanOutOutputWriter struct {
+	Outputs []*fanOutOutput
+	// Progress is told how many files were written for each bookmark,
+	// across every writer.
+	Progress *progressReporter
+}
+
+// Preflight prepares every writer. Writers which can't be prepared are left
+// out of the run, which only fails if none of them could be.
+func (w *fanOutOutputWriter) Preflight() error {
+	var errs []string
+	for _, output := range w.Outputs {
+		if err := output.Writer.Preflight(); err != nil {
+			slog.Error("error preparing output, skipping it", "format", output.Format, "error", err)
+			output.preflightErr = err
+			errs = append(errs, output.Format+": "+err.Error())
+		}
+	}
+	if len(errs) == len(w.Outputs) {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Write writes the bookmark to every writer, returning the errors of any
+// which failed.
+func (w *fanOutOutputWriter) Write(bookmark bookmarkData) error {
+	var errs []string
+	files := 0
+	for _, output := range w.Outputs {
+		if output.preflightErr != nil {
+			continue
+		}
+		n, err := output.write(bookmark)
+		files += n
+		if err != nil {
+			atomic.AddInt64(&output.failures, 1)
+			errs = append(errs, output.Format+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	w.Progress.BookmarkWritten(files)
+	return nil
+}
+
+// Close closes every writer, and reports those which couldn't be prepared
+// or closed as errors.
+func (w *fanOutOutputWriter) Close() error {
+	var errs []string
+	for _, output := range w.Outputs {
+		if output.preflightErr != nil {
+			errs = append(errs, output.Format+": not written: "+output.preflightErr.Error())
+			continue
+		}
+		if failures := atomic.LoadInt64(&output.failures); failures > 0 {
+			slog.Warn("output failed to write some bookmarks", "format", output.Format, "failed", failures)
+		}
+		if err := output.Writer.Close(); err != nil {
+			slog.Error("error closing output", "format", output.Format, "error", err)
+			errs = append(errs, output.Format+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
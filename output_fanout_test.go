@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var fanOutOutputWriterTestDir = filepath.Join("tmp", "fanOutOutputWriter")
+
+// brokenOutputWriter fails at whichever step it's told to.
+type brokenOutputWriter struct {
+	PreflightErr, WriteErr error
+	writes                 int
+}
+
+func (w *brokenOutputWriter) Preflight() error { return w.PreflightErr }
+
+func (w *brokenOutputWriter) Write(bookmarkData) error {
+	w.writes++
+	return w.WriteErr
+}
+
+func (w *brokenOutputWriter) Close() error { return nil }
+
+func TestOutputOptions_Formats(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		{args: nil, expected: []string{"jekyll"}},
+		{args: []string{"-format=markdown"}, expected: []string{"markdown"}},
+		{args: []string{"-format=jekyll, WARC"}, expected: []string{"jekyll", "warc"}},
+		{args: []string{"-format=jekyll", "-format=hugo,epub"}, expected: []string{"jekyll", "hugo", "epub"}},
+	} {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		var options outputOptions
+		options.RegisterFlags(flags)
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatalf("unable to parse %v: %v", test.args, err)
+		}
+		formats, err := options.Formats()
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", test.args, err)
+		}
+		if !reflect.DeepEqual(formats, test.expected) {
+			t.Errorf("expected %v for %v, got %v", test.expected, test.args, formats)
+		}
+	}
+
+	for _, format := range []string{"jekyll,jekyll", " , "} {
+		if _, err := (outputOptions{Format: format}).Formats(); err == nil {
+			t.Errorf("expected an error for %q", format)
+		}
+	}
+	if _, err := newOutputWriter(fanOutOutputWriterTestDir, fanOutOutputWriterTestDir, outputOptions{Format: "jekyll,pdf"}, nil); err == nil || !strings.Contains(err.Error(), `"pdf"`) {
+		t.Errorf("expected an unsupported format error, got %v", err)
+	}
+}
+
+func TestFanOutOutputWriter_WritesEachFormat(t *testing.T) {
+	defer cleanupTestTmpDir(fanOutOutputWriterTestDir)
+	newWriter := func(progress *progressReporter) OutputWriter {
+		w, err := newOutputWriter(fanOutOutputWriterTestDir, fanOutOutputWriterTestDir, outputOptions{Format: "jekyll,markdown", JekyllPostExtension: "html"}, progress)
+		if err != nil {
+			t.Fatalf("unable to create writer: %v", err)
+		}
+		if err := w.Preflight(); err != nil {
+			t.Fatalf("preflight failed: %v", err)
+		}
+		return w
+	}
+
+	progress := &progressReporter{}
+	w := newWriter(progress)
+	if err := w.Write(newTestBookmark(1234, "<p>full text</p>")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	fileContentsMatch(t, filepath.Join(fanOutOutputWriterTestDir, "jekyll", "_mirror", "1234.html"), "<p>full text</p>")
+	fileContentsMatch(t, filepath.Join(fanOutOutputWriterTestDir, "markdown", "2010-11-01-1234.md"), "full text")
+	fileContentsMatch(t, filepath.Join(fanOutOutputWriterTestDir, "markdown", syncManifestFileName), `"hash1234"`)
+	if files := progress.FilesWritten(); files != 4 {
+		t.Errorf("expected 4 files to be written across both formats, got %d", files)
+	}
+
+	// A bookmark unchanged in every format is counted as unchanged once.
+	progress = &progressReporter{}
+	w = newWriter(progress)
+	if err := w.Write(newTestBookmark(1234, "<p>full text</p>")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if unchanged := atomic.LoadInt64(&progress.unchanged); unchanged != 1 {
+		t.Errorf("expected the bookmark to be unchanged once, got %d", unchanged)
+	}
+}
+
+func TestFanOutOutputWriter_IsolatesFailures(t *testing.T) {
+	defer cleanupTestTmpDir(fanOutOutputWriterTestDir)
+	markdownDir := filepath.Join(fanOutOutputWriterTestDir, "markdown")
+	failing := &brokenOutputWriter{WriteErr: errors.New("disk full")}
+	unprepared := &brokenOutputWriter{PreflightErr: errors.New("bad template")}
+	w := &fanOutOutputWriter{Outputs: []*fanOutOutput{
+		{Format: "broken", Writer: failing},
+		{Format: "unprepared", Writer: unprepared},
+		{Format: "markdown", Writer: markdownOutputWriter{Directory: markdownDir}},
+	}}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("expected preflight to succeed with some writers, got %v", err)
+	}
+
+	err := w.Write(newTestBookmark(1234, "<p>full text</p>"))
+	if err == nil || err.Error() != "broken: disk full" {
+		t.Fatalf("expected the broken writer's error, got %v", err)
+	}
+	fileContentsMatch(t, filepath.Join(markdownDir, "2010-11-01-1234.md"), "full text")
+	if unprepared.writes != 0 {
+		t.Errorf("expected the unprepared writer to be skipped")
+	}
+	if w.Outputs[0].failures != 1 || w.Outputs[2].failures != 0 {
+		t.Errorf("expected failures to be counted per writer, got %d and %d", w.Outputs[0].failures, w.Outputs[2].failures)
+	}
+
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), "unprepared: not written: bad template") {
+		t.Fatalf("expected close to report the unprepared writer, got %v", err)
+	}
+
+	// The run only fails to start if no writer can be prepared.
+	w = &fanOutOutputWriter{Outputs: []*fanOutOutput{
+		{Format: "unprepared", Writer: unprepared},
+	}}
+	if err := w.Preflight(); err == nil {
+		t.Fatalf("expected preflight to fail without any writers")
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlSiteFS holds the templates and assets for the html format.
+//
+//go:embed html_site
+var htmlSiteFS embed.FS
+
+var (
+	htmlSiteListTemplate     = parseHTMLSiteTemplate("list")
+	htmlSiteBookmarkTemplate = parseHTMLSiteTemplate("bookmark")
+	htmlSiteSearchTemplate   = parseHTMLSiteTemplate("search")
+)
+
+func parseHTMLSiteTemplate(name string) *template.Template {
+	return template.Must(template.ParseFS(htmlSiteFS, "html_site/templates/layout.html", "html_site/templates/"+name+".html"))
+}
+
+// htmlSiteFileName records every bookmark in an html archive, so the index
+// pages list bookmarks archived by previous runs too.
+const htmlSiteFileName = ".html-site.json"
+
+// htmlSiteDefaultPageSize is the number of bookmarks on each index page.
+const htmlSiteDefaultPageSize = 50
+
+// htmlSiteSearchTextLength caps how much of each bookmark's text is in the
+// search index, so it stays small enough to load in a browser.
+const htmlSiteSearchTextLength = 5000
+
+// htmlSiteEntry is a bookmark as it's listed and searched.
+type htmlSiteEntry struct {
+	ID             string `json:"id"`
+	Title          string `json:"title"`
+	URL            string `json:"url"`
+	Folder         string `json:"folder"`
+	Date           string `json:"date"`
+	Saved          int64  `json:"saved"`
+	Path           string `json:"path"`
+	HighlightCount int    `json:"highlight_count"`
+	Highlights     string `json:"highlights"`
+	Text           string `json:"text"`
+}
+
+type htmlSiteFolder struct {
+	Name string
+	Path string
+}
+
+type htmlSitePagination struct {
+	Page, Pages int
+	Prev, Next  string
+}
+
+type htmlSiteBookmark struct {
+	URL, Date, Folder string
+	FullText          template.HTML
+	Highlights        []htmlSiteHighlight
+}
+
+type htmlSiteHighlight struct {
+	Text, Note string
+}
+
+// htmlSitePage is what each page's template is executed with. Root is the
+// relative path from the page to the root of the site.
+type htmlSitePage struct {
+	Title      string
+	Root       string
+	Folders    []htmlSiteFolder
+	Entries    []htmlSiteEntry
+	Pagination *htmlSitePagination
+	Bookmark   *htmlSiteBookmark
+}
+
+// htmlSiteOutputWriter writes a static site which can be browsed straight
+// from disk: an index of bookmarks by date, one per folder, a page per
+// bookmark, and a search page. Bookmark pages are written as they come in;
+// everything else is written by Close.
+type htmlSiteOutputWriter struct {
+	Directory string
+	// ArchiveDirectory is where mirrored images are copied from, into the
+	// site's images directory. If empty, it's Directory.
+	ArchiveDirectory string
+	// Force rewrites every file, regardless of what the manifest says.
+	Force bool
+	// Manifest records what was last written for each bookmark so only the
+	// files whose inputs changed are rewritten. If nil, existing files are
+	// never rewritten.
+	Manifest *syncManifest
+	// Progress is told how many files were written for each bookmark.
+	Progress *progressReporter
+	// PageSize is the number of bookmarks on each index page. If zero,
+	// htmlSiteDefaultPageSize is used.
+	PageSize int
+
+	mu      sync.Mutex
+	entries map[string]htmlSiteEntry
+}
+
+func (w *htmlSiteOutputWriter) archiveDir() string {
+	if w.ArchiveDirectory != "" {
+		return w.ArchiveDirectory
+	}
+	return w.Directory
+}
+
+func (w *htmlSiteOutputWriter) Preflight() error {
+	for _, dir := range []string{w.Directory, filepath.Join(w.Directory, "bookmarks"), filepath.Join(w.Directory, "folders"), filepath.Join(w.Directory, "assets")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := removeAtomicWriteTempFiles(dir); err != nil {
+			return err
+		}
+	}
+	w.entries = map[string]htmlSiteEntry{}
+	if sitePath := filepath.Join(w.Directory, htmlSiteFileName); fileExists(sitePath) {
+		data, err := ioutil.ReadFile(sitePath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &w.entries); err != nil {
+			return fmt.Errorf("error reading %s: %v", sitePath, err)
+		}
+	}
+	if err := w.writeAssets(); err != nil {
+		return err
+	}
+	return w.Manifest.Load()
+}
+
+func (w *htmlSiteOutputWriter) writeAssets() error {
+	return fs.WalkDir(htmlSiteFS, "html_site/assets", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := htmlSiteFS.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(filepath.Join(w.Directory, "assets", path.Base(p)), data, 0644)
+	})
+}
+
+func (w *htmlSiteOutputWriter) Write(bookmark bookmarkData) error {
+	files, err := w.writeFiles(bookmark)
+	if err != nil {
+		return err
+	}
+	w.Progress.BookmarkWritten(files)
+	return nil
+}
+
+// writeFiles writes the bookmark, returning how many files it wrote.
+func (w *htmlSiteOutputWriter) writeFiles(bookmark bookmarkData) (int, error) {
+	changes := w.Manifest.Changes(bookmark)
+	changed := w.Force || changes.Post
+	entry, err := newHTMLSiteEntry(bookmark)
+	if err != nil {
+		slog.Error("error indexing bookmark", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
+	}
+	written, err := w.writeBookmarkPage(bookmark, entry, changed)
+	if err != nil {
+		slog.Error("error writing bookmark page", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
+	}
+
+	w.mu.Lock()
+	if prev, ok := w.entries[entry.ID]; ok {
+		// Missing full text or highlights usually mean we failed to fetch
+		// them this time, so keep what was indexed before.
+		if entry.Text == "" {
+			entry.Text = prev.Text
+		}
+		if entry.HighlightCount == 0 && !bookmark.HighlightsFetched {
+			entry.HighlightCount, entry.Highlights = prev.HighlightCount, prev.Highlights
+		}
+	}
+	w.entries[entry.ID] = entry
+	w.mu.Unlock()
+
+	w.Manifest.Update(bookmark)
+	filesWritten := 0
+	if written {
+		filesWritten = 1
+	}
+	return filesWritten, nil
+}
+
+func newHTMLSiteEntry(bookmark bookmarkData) (htmlSiteEntry, error) {
+	data := newPostData(bookmark)
+	entry := htmlSiteEntry{
+		ID:             data.ID,
+		Title:          data.Title,
+		URL:            data.URL,
+		Folder:         data.Folder,
+		Date:           bookmark.GetYYYYMMDD(),
+		Saved:          data.Saved.Unix(),
+		Path:           path.Join("bookmarks", fmt.Sprintf("%s-%s.html", bookmark.GetYYYYMMDD(), data.ID)),
+		HighlightCount: len(data.Highlights),
+	}
+	if data.Saved.IsZero() {
+		entry.Saved = data.Date.Unix()
+	}
+	highlights := make([]string, 0, len(data.Highlights))
+	for _, highlight := range data.Highlights {
+		highlights = append(highlights, highlight.Text, highlight.Note)
+	}
+	entry.Highlights = strings.TrimSpace(strings.Join(highlights, "\n"))
+	if len(data.FullText) > 0 {
+		text, err := htmlToText(data.FullText)
+		if err != nil {
+			return entry, err
+		}
+		text = strings.Join(strings.Fields(text), " ")
+		if runes := []rune(text); len(runes) > htmlSiteSearchTextLength {
+			text = string(runes[:htmlSiteSearchTextLength])
+		}
+		entry.Text = text
+	}
+	return entry, nil
+}
+
+func (w *htmlSiteOutputWriter) writeBookmarkPage(bookmark bookmarkData, entry htmlSiteEntry, changed bool) (bool, error) {
+	outputFilePath := filepath.Join(w.Directory, filepath.FromSlash(entry.Path))
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
+	}
+	root := strings.Repeat("../", strings.Count(entry.Path, "/"))
+	fullText, err := localizeAssets(bookmark, w.archiveDir(), filepath.Join(w.Directory, "images"), root+"images/")
+	if err != nil {
+		return false, err
+	}
+	fullText, err = sanitizeHTML(fullText)
+	if err != nil {
+		return false, err
+	}
+	page := htmlSitePage{
+		Title: entry.Title,
+		Bookmark: &htmlSiteBookmark{
+			URL:      entry.URL,
+			Date:     entry.Date,
+			Folder:   entry.Folder,
+			FullText: template.HTML(fullText),
+		},
+	}
+	if slugify(entry.Folder) != "" {
+		page.Folders = []htmlSiteFolder{htmlSiteFolderFor(entry.Folder)}
+	}
+	for _, highlight := range bookmark.Highlights {
+		page.Bookmark.Highlights = append(page.Bookmark.Highlights, htmlSiteHighlight{Text: highlight.Text, Note: highlight.Note})
+	}
+	return true, w.writePage(htmlSiteBookmarkTemplate, entry.Path, page)
+}
+
+// writePage renders page at p, a slash-separated path relative to the root
+// of the site.
+func (w *htmlSiteOutputWriter) writePage(tmpl *template.Template, p string, page htmlSitePage) error {
+	page.Root = strings.Repeat("../", strings.Count(p, "/"))
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "layout", page); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(w.Directory, filepath.FromSlash(p)), buf.Bytes(), 0644)
+}
+
+func htmlSiteFolderFor(folder string) htmlSiteFolder {
+	return htmlSiteFolder{Name: folder, Path: path.Join("folders", slugify(folder)+".html")}
+}
+
+// Close writes the index, folder and search pages for every bookmark
+// archived so far.
+func (w *htmlSiteOutputWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.entries == nil {
+		return nil
+	}
+
+	entries := make([]htmlSiteEntry, 0, len(w.entries))
+	byFolder := map[string][]htmlSiteEntry{}
+	for _, entry := range w.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Saved != entries[j].Saved {
+			return entries[i].Saved > entries[j].Saved
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	var folders []htmlSiteFolder
+	for _, entry := range entries {
+		if slugify(entry.Folder) == "" {
+			continue
+		}
+		if _, ok := byFolder[entry.Folder]; !ok {
+			folders = append(folders, htmlSiteFolderFor(entry.Folder))
+		}
+		byFolder[entry.Folder] = append(byFolder[entry.Folder], entry)
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return strings.ToLower(folders[i].Name) < strings.ToLower(folders[j].Name)
+	})
+
+	if err := w.writeListing("All bookmarks", "index", entries, folders); err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		base := strings.TrimSuffix(folder.Path, ".html")
+		if err := w.writeListing(folder.Name, base, byFolder[folder.Name], folders); err != nil {
+			return err
+		}
+	}
+	if err := w.writePage(htmlSiteSearchTemplate, "search.html", htmlSitePage{Title: "Search", Folders: folders}); err != nil {
+		return err
+	}
+
+	searchIndex, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	searchIndexJS := append(append([]byte("var searchIndex = "), searchIndex...), ";\n"...)
+	if err := writeFileAtomic(filepath.Join(w.Directory, "search-index.js"), searchIndexJS, 0644); err != nil {
+		return err
+	}
+	site, err := json.Marshal(w.entries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(w.Directory, htmlSiteFileName), site, 0644); err != nil {
+		return err
+	}
+	return w.Manifest.Save()
+}
+
+// writeListing writes entries in pages of PageSize: base.html, then
+// base-2.html and so on.
+func (w *htmlSiteOutputWriter) writeListing(title, base string, entries []htmlSiteEntry, folders []htmlSiteFolder) error {
+	pageSize := w.PageSize
+	if pageSize <= 0 {
+		pageSize = htmlSiteDefaultPageSize
+	}
+	pages := (len(entries) + pageSize - 1) / pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	pagePath := func(page int) string {
+		if page == 1 {
+			return base + ".html"
+		}
+		return fmt.Sprintf("%s-%d.html", base, page)
+	}
+	for page := 1; page <= pages; page++ {
+		start, end := (page-1)*pageSize, page*pageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		pagination := &htmlSitePagination{Page: page, Pages: pages}
+		if page > 1 {
+			pagination.Prev = pagePath(page - 1)
+		}
+		if page < pages {
+			pagination.Next = pagePath(page + 1)
+		}
+		err := w.writePage(htmlSiteListTemplate, pagePath(page), htmlSitePage{
+			Title:      title,
+			Folders:    folders,
+			Entries:    entries[start:end],
+			Pagination: pagination,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// htmlSiteUnsafeElements are dropped, along with everything in them, from
+// the full text before it's embedded in a page. SVG and MathML can animate
+// their own attributes into links, so they're dropped whole too.
+var htmlSiteUnsafeElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Object:   true,
+	atom.Applet:   true,
+	atom.Embed:    true,
+	atom.Form:     true,
+	atom.Textarea: true,
+	atom.Select:   true,
+	atom.Head:     true,
+	atom.Title:    true,
+	atom.Noscript: true,
+	atom.Noembed:  true,
+	atom.Noframes: true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Math:     true,
+}
+
+// htmlSiteAllowedElements are kept in the full text. Anything else, like
+// html, body or font, is dropped but its contents are kept.
+var htmlSiteAllowedElements = map[atom.Atom]bool{
+	atom.A: true, atom.Abbr: true, atom.Address: true, atom.Article: true,
+	atom.Aside: true, atom.B: true, atom.Bdi: true, atom.Bdo: true,
+	atom.Blockquote: true, atom.Br: true, atom.Caption: true, atom.Cite: true,
+	atom.Code: true, atom.Col: true, atom.Colgroup: true, atom.Dd: true,
+	atom.Del: true, atom.Details: true, atom.Dfn: true, atom.Div: true,
+	atom.Dl: true, atom.Dt: true, atom.Em: true, atom.Figcaption: true,
+	atom.Figure: true, atom.Footer: true, atom.H1: true, atom.H2: true,
+	atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.I: true, atom.Img: true,
+	atom.Ins: true, atom.Kbd: true, atom.Li: true, atom.Main: true,
+	atom.Mark: true, atom.Ol: true, atom.P: true, atom.Picture: true,
+	atom.Pre: true, atom.Q: true, atom.Rp: true, atom.Rt: true,
+	atom.Ruby: true, atom.S: true, atom.Samp: true, atom.Section: true,
+	atom.Small: true, atom.Source: true, atom.Span: true, atom.Strong: true,
+	atom.Sub: true, atom.Summary: true, atom.Sup: true, atom.Table: true,
+	atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true,
+	atom.Thead: true, atom.Time: true, atom.Tr: true, atom.U: true,
+	atom.Ul: true, atom.Var: true, atom.Wbr: true,
+}
+
+// htmlSiteAllowedAttributes are kept on allowed elements. Event handlers,
+// styles and anything else are dropped.
+var htmlSiteAllowedAttributes = map[string]bool{
+	"abbr":     true,
+	"alt":      true,
+	"cite":     true,
+	"colspan":  true,
+	"datetime": true,
+	"dir":      true,
+	"headers":  true,
+	"height":   true,
+	"href":     true,
+	"id":       true,
+	"lang":     true,
+	"media":    true,
+	"open":     true,
+	"reversed": true,
+	"rowspan":  true,
+	"scope":    true,
+	"sizes":    true,
+	"span":     true,
+	"src":      true,
+	"srcset":   true,
+	"start":    true,
+	"title":    true,
+	"type":     true,
+	"width":    true,
+}
+
+// htmlSiteURLAttributes are the allowed attributes whose values are URLs,
+// which are dropped unless they're safe to follow.
+var htmlSiteURLAttributes = map[string]bool{
+	"href":   true,
+	"src":    true,
+	"srcset": true,
+	"cite":   true,
+}
+
+// sanitizeHTML keeps only the elements and attributes known to be safe in
+// the HTML returned by Instapaper's text endpoint, dropping scripts,
+// styles, embedded content, event handlers and URLs which could run
+// script, e.g. javascript:.
+func sanitizeHTML(input string) (string, error) {
+	var buf strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(input))
+	skipping := 0
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if err := tokenizer.Err(); err != io.EOF {
+				return "", err
+			}
+			return buf.String(), nil
+		}
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.StartTagToken:
+			if htmlSiteUnsafeElements[token.DataAtom] {
+				skipping++
+				continue
+			}
+		case html.EndTagToken:
+			if htmlSiteUnsafeElements[token.DataAtom] {
+				if skipping > 0 {
+					skipping--
+				}
+				continue
+			}
+		case html.SelfClosingTagToken:
+			if htmlSiteUnsafeElements[token.DataAtom] {
+				continue
+			}
+		case html.CommentToken, html.DoctypeToken:
+			continue
+		}
+		if skipping > 0 {
+			continue
+		}
+		if tokenType != html.TextToken && !htmlSiteAllowedElements[token.DataAtom] {
+			continue
+		}
+		attrs := token.Attr[:0]
+		for _, attr := range token.Attr {
+			key := strings.ToLower(attr.Key)
+			if attr.Namespace != "" || !htmlSiteAllowedAttributes[key] || htmlSiteURLAttributes[key] && !safeAttributeURLs(key, attr.Val) {
+				continue
+			}
+			attrs = append(attrs, attr)
+		}
+		token.Attr = attrs
+		buf.WriteString(token.String())
+	}
+}
+
+// safeAttributeURLs reports whether every URL in the attribute is safe to
+// follow. srcset lists several, each followed by a size.
+func safeAttributeURLs(key, value string) bool {
+	if key != "srcset" {
+		return safeURL(value)
+	}
+	for _, candidate := range strings.Split(value, ",") {
+		if fields := strings.Fields(candidate); len(fields) > 0 && !safeURL(fields[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// safeURL reports whether the URL is relative, or uses the http, https or
+// mailto scheme. Browsers ignore ASCII whitespace and control characters in
+// URLs, e.g. "java\tscript:", so they're ignored here too.
+func safeURL(u string) bool {
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+	colon := strings.IndexByte(u, ':')
+	if colon < 0 {
+		return true
+	}
+	// A colon after the start of the path, query or fragment isn't part of
+	// a scheme.
+	if i := strings.IndexAny(u, "/?#"); i >= 0 && i < colon {
+		return true
+	}
+	switch strings.ToLower(u[:colon]) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var htmlSiteOutputWriterTestDir = filepath.Join("tmp", "htmlSiteOutputWriter")
+
+func TestHTMLSiteOutputWriter_Write(t *testing.T) {
+	w := &htmlSiteOutputWriter{Directory: htmlSiteOutputWriterTestDir, PageSize: 2}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(htmlSiteOutputWriterTestDir)
+
+	for i := 1; i <= 3; i++ {
+		bookmark := bookmarkData{
+			Bookmark: &instapaper.Bookmark{
+				ID:    i,
+				Title: fmt.Sprintf("Bookmark <%d>", i),
+				URL:   fmt.Sprintf("https://example.com/%d", i),
+				Time:  float32(1288608076 + i*86400),
+			},
+			FullText:         fmt.Sprintf(`<p onclick="evil()">Text of bookmark %d</p><script>alert(1)</script><a href="javascript:evil()">link</a>`, i),
+			Highlights:       []instapaper.Highlight{{Text: fmt.Sprintf("Highlight %d", i), Note: "A note"}},
+			ContainingFolder: "Unread",
+		}
+		if i == 3 {
+			bookmark.ContainingFolder = "Books To Read"
+		}
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	bookmarkPath := filepath.Join(w.Directory, "bookmarks", "2010-11-02-1.html")
+	fileContentsMatch(t, bookmarkPath, "<title>Bookmark &lt;1&gt;</title>")
+	fileContentsMatch(t, bookmarkPath, `<link rel="stylesheet" href="../assets/style.css">`)
+	fileContentsMatch(t, bookmarkPath, "<p>Text of bookmark 1</p><a>link</a>")
+	fileContentsMatch(t, bookmarkPath, "<blockquote>Highlight 1</blockquote>")
+	fileContentsMatch(t, bookmarkPath, `<p class="note">A note</p>`)
+	contents, err := ioutil.ReadFile(bookmarkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, unsafe := range []string{"<script>alert", "onclick", "javascript:"} {
+		if strings.Contains(string(contents), unsafe) {
+			t.Errorf("expected %q to be stripped from the bookmark page", unsafe)
+		}
+	}
+
+	// Newest first, two per page.
+	index := filepath.Join(w.Directory, "index.html")
+	fileContentsMatch(t, index, `<a href="bookmarks/2010-11-04-3.html">Bookmark &lt;3&gt;</a>`)
+	fileContentsMatch(t, index, `<a href="bookmarks/2010-11-03-2.html">Bookmark &lt;2&gt;</a>`)
+	fileContentsMatch(t, index, `<a href="index-2.html">Older</a>`)
+	fileContentsMatch(t, index, `<a href="folders/books-to-read.html">Books To Read</a>`)
+	fileContentsMatch(t, filepath.Join(w.Directory, "index-2.html"), `<a href="bookmarks/2010-11-02-1.html">Bookmark &lt;1&gt;</a>`)
+	fileContentsMatch(t, filepath.Join(w.Directory, "index-2.html"), `<a href="index.html">Newer</a>`)
+
+	unread := filepath.Join(w.Directory, "folders", "unread.html")
+	fileContentsMatch(t, unread, `<a href="../bookmarks/2010-11-03-2.html">`)
+	fileContentsMatch(t, unread, "Page 1 of 1")
+
+	fileContentsMatch(t, filepath.Join(w.Directory, "search.html"), `<script src="search-index.js"></script>`)
+	fileContentsMatch(t, filepath.Join(w.Directory, "search-index.js"), `"text":"Text of bookmark 1 link"`)
+	fileContentsMatch(t, filepath.Join(w.Directory, "assets", "search.js"), "searchIndex")
+	fileContentsMatch(t, filepath.Join(w.Directory, "assets", "style.css"), ".highlights")
+}
+
+func TestHTMLSiteOutputWriter_KeepsPreviousRuns(t *testing.T) {
+	defer cleanupTestTmpDir(htmlSiteOutputWriterTestDir)
+	for i := 1; i <= 2; i++ {
+		w := &htmlSiteOutputWriter{Directory: htmlSiteOutputWriterTestDir}
+		if err := w.Preflight(); err != nil {
+			t.Fatalf("preflight failed: %v", err)
+		}
+		bookmark := bookmarkData{Bookmark: &instapaper.Bookmark{ID: i, Title: fmt.Sprintf("Run %d", i), Time: 1288608076}}
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+	}
+	fileContentsMatch(t, filepath.Join(htmlSiteOutputWriterTestDir, "index.html"), ">Run 1</a>")
+	fileContentsMatch(t, filepath.Join(htmlSiteOutputWriterTestDir, "index.html"), ">Run 2</a>")
+}
+
+func TestSanitizeHTML_URLs(t *testing.T) {
+	tests := map[string]string{
+		`<a href="javascript:evil()">x</a>`:                                                             `<a>x</a>`,
+		`<a href="java&#x09;script:evil()">x</a>`:                                                       `<a>x</a>`,
+		`<a href=" &#x01;JaVaScRiPt:evil()">x</a>`:                                                      `<a>x</a>`,
+		`<a href="java&#x0A;script&#x3A;evil()">x</a>`:                                                  `<a>x</a>`,
+		`<a href="vbscript:msgbox(1)">x</a>`:                                                            `<a>x</a>`,
+		`<iframe src="data:text/html,evil"></iframe><a href="data:text/html;base64,PHNjcmlwdD4=">x</a>`: `<a>x</a>`,
+		`<img src="x.png" srcset="a.png 1x, javascript:evil() 2x">`:                                     `<img src="x.png">`,
+		`<a href="https://example.com/a:b">x</a>`:                                                       `<a href="https://example.com/a:b">x</a>`,
+		`<a href="HTTP://example.com">x</a>`:                                                            `<a href="HTTP://example.com">x</a>`,
+		`<a href="mailto:someone@example.com">x</a>`:                                                    `<a href="mailto:someone@example.com">x</a>`,
+		`<a href="../page?at=12:30#top">x</a>`:                                                          `<a href="../page?at=12:30#top">x</a>`,
+		`<img src="a.png" srcset="a.png 1x, https://example.com/b.png 2x">`:                             `<img src="a.png" srcset="a.png 1x, https://example.com/b.png 2x">`,
+		`<a title="javascript: the good parts">x</a>`:                                                   `<a title="javascript: the good parts">x</a>`,
+	}
+	for input, expected := range tests {
+		actual, err := sanitizeHTML(input)
+		if err != nil {
+			t.Fatalf("unable to sanitize %q: %v", input, err)
+		}
+		if actual != expected {
+			t.Errorf("sanitizeHTML(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestSanitizeHTML_Elements(t *testing.T) {
+	tests := map[string]string{
+		`<svg><a><animate attributeName="href" values="javascript:alert(1)"/><text x="20" y="20">x</text></a></svg><p>after</p>`: `<p>after</p>`,
+		`<math><mi xlink:href="javascript:alert(1)">x</mi></math>`:                                                               ``,
+		`<template><img src="x.png"></template><p>kept</p>`:                                                                      `<p>kept</p>`,
+		`<p style="position:fixed" class="x" onclick="evil()">text</p>`:                                                          `<p>text</p>`,
+		`<font color="red"><center>text</center></font>`:                                                                         `text`,
+		`<a href="https://example.com" target="_blank" xlink:href="javascript:evil()">x</a>`:                                     `<a href="https://example.com">x</a>`,
+	}
+	for input, expected := range tests {
+		actual, err := sanitizeHTML(input)
+		if err != nil {
+			t.Fatalf("unable to sanitize %q: %v", input, err)
+		}
+		if actual != expected {
+			t.Errorf("sanitizeHTML(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Front matter formats for Hugo pages.
+const (
+	hugoFrontMatterTOML = "toml"
+	hugoFrontMatterYAML = "yaml"
+)
+
+// hugoOutputWriter writes a page bundle per bookmark in
+// content/bookmarks/<slug>/, with the mirrored full text and highlights as
+// bundle resources, a term page per folder in content/folders/, and the
+// bookmark's metadata in data/bookmarks/<id>.json. The folder and tag
+// taxonomies are declared in config/_default/.
+type hugoOutputWriter struct {
+	Directory string
+	// ArchiveDirectory is where mirrored images are copied from, into each
+	// page bundle. If empty, it's Directory.
+	ArchiveDirectory string
+	// FrontMatter is the front matter format, toml or yaml. If empty, TOML
+	// is written.
+	FrontMatter string
+	// Force rewrites every file, regardless of what the manifest says.
+	Force bool
+	// Manifest records what was last written for each bookmark so only the
+	// files whose inputs changed are rewritten. If nil, existing files are
+	// never rewritten.
+	Manifest *syncManifest
+	// Progress is told how many files were written for each bookmark.
+	Progress *progressReporter
+}
+
+// hugoFrontMatter is the front matter of each bookmark's page. Folders are
+// the "folders" taxonomy.
+type hugoFrontMatter struct {
+	Title       string         `toml:"title" yaml:"title"`
+	Date        time.Time      `toml:"date" yaml:"date"`
+	Description string         `toml:"description,omitempty" yaml:"description,omitempty"`
+	Folders     []string       `toml:"folders,omitempty" yaml:"folders,omitempty"`
+	Tags        []string       `toml:"tags,omitempty" yaml:"tags,omitempty"`
+	Params      hugoPageParams `toml:"params" yaml:"params"`
+}
+
+type hugoPageParams struct {
+	ArchiveID      string  `toml:"archive_id" yaml:"archive_id"`
+	URL            string  `toml:"url" yaml:"url"`
+	Starred        bool    `toml:"starred" yaml:"starred"`
+	Progress       float32 `toml:"progress" yaml:"progress"`
+	HighlightCount int     `toml:"highlight_count" yaml:"highlight_count"`
+}
+
+func (w hugoOutputWriter) archiveDir() string {
+	if w.ArchiveDirectory != "" {
+		return w.ArchiveDirectory
+	}
+	return w.Directory
+}
+
+func (w hugoOutputWriter) dirs() []string {
+	return []string{
+		filepath.Join(w.Directory, "content", "bookmarks"),
+		filepath.Join(w.Directory, "content", "folders"),
+		filepath.Join(w.Directory, "data", "bookmarks"),
+	}
+}
+
+func (w hugoOutputWriter) Preflight() error {
+	switch w.FrontMatter {
+	case "", hugoFrontMatterTOML, hugoFrontMatterYAML:
+	default:
+		return fmt.Errorf("unsupported front matter format: %q", w.FrontMatter)
+	}
+	for _, dir := range w.dirs() {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := removeAtomicWriteTempFiles(dir); err != nil {
+			return err
+		}
+	}
+	if err := w.writeTaxonomyConfig(); err != nil {
+		return err
+	}
+	return w.Manifest.Load()
+}
+
+// hugoTaxonomies are the taxonomies used in the front matter, keyed by
+// their singular name as in Hugo's config.
+var hugoTaxonomies = map[string]string{"folder": "folders", "tag": "tags"}
+
+// writeTaxonomyConfig declares the taxonomies in the site config, unless
+// they've already been configured there.
+func (w hugoOutputWriter) writeTaxonomyConfig() error {
+	configDir := filepath.Join(w.Directory, "config", "_default")
+	existing, err := filepath.Glob(filepath.Join(configDir, "taxonomies.*"))
+	if err != nil || len(existing) > 0 {
+		return err
+	}
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	name := "taxonomies.toml"
+	if w.FrontMatter == hugoFrontMatterYAML {
+		name = "taxonomies.yaml"
+		if err := yaml.NewEncoder(&buf).Encode(hugoTaxonomies); err != nil {
+			return err
+		}
+	} else if err := toml.NewEncoder(&buf).Encode(hugoTaxonomies); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(configDir, name), buf.Bytes(), 0644)
+}
+
+func (w hugoOutputWriter) Write(bookmark bookmarkData) error {
+	files, err := w.writeFiles(bookmark)
+	if err != nil {
+		return err
+	}
+	w.Progress.BookmarkWritten(files)
+	return nil
+}
+
+// writeFiles writes the bookmark, returning how many files it wrote.
+func (w hugoOutputWriter) writeFiles(bookmark bookmarkData) (int, error) {
+	changes := w.Manifest.Changes(bookmark)
+	if w.Force {
+		changes = allSyncManifestChanges
+	}
+	bundleDir := filepath.Join(w.Directory, "content", "bookmarks", fmt.Sprintf("%s-%s", bookmark.GetYYYYMMDD(), bookmark.GetID()))
+	if err := os.MkdirAll(bundleDir, 0755); err != nil {
+		slog.Error("error creating page bundle", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
+	}
+	if err := removeAtomicWriteTempFiles(bundleDir); err != nil {
+		return 0, err
+	}
+
+	filesWritten := 0
+	steps := []struct {
+		name  string
+		write func() (bool, error)
+	}{
+		{"data", func() (bool, error) { return w.writeDataFile(bookmark, changes.Metadata) }},
+		{"page", func() (bool, error) { return w.writePage(bundleDir, bookmark, changes.Post) }},
+		{"text", func() (bool, error) { return w.writeTextResource(bundleDir, bookmark, changes.FullText) }},
+		{"highlights", func() (bool, error) { return w.writeHighlightsResource(bundleDir, bookmark, changes.Highlights) }},
+		{"folder", func() (bool, error) { return w.writeFolderPage(bookmark) }},
+	}
+	for _, step := range steps {
+		written, err := step.write()
+		if err != nil {
+			slog.Error("error writing hugo "+step.name, bookmark.logArgs("stage", logStageWrite, "error", err)...)
+			return 0, err
+		}
+		if written {
+			filesWritten++
+		}
+	}
+	w.Manifest.Update(bookmark)
+	return filesWritten, nil
+}
+
+func (w hugoOutputWriter) Close() error {
+	return w.Manifest.Save()
+}
+
+func (w hugoOutputWriter) writeDataFile(bookmark bookmarkData, changed bool) (bool, error) {
+	outputFilePath := filepath.Join(w.Directory, "data", "bookmarks", bookmark.GetID()+".json")
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
+	}
+	data, err := json.MarshalIndent(bookmark, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(outputFilePath, data, 0644)
+}
+
+func (w hugoOutputWriter) writePage(bundleDir string, bookmark bookmarkData, changed bool) (bool, error) {
+	outputFilePath := filepath.Join(bundleDir, "index.md")
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
+	}
+	fullText, err := localizeAssets(bookmark, w.archiveDir(), bundleDir, "")
+	if err != nil {
+		return false, err
+	}
+	bookmark.FullText = fullText
+	var buf bytes.Buffer
+	if err := w.writeFrontMatter(&buf, newHugoFrontMatter(bookmark)); err != nil {
+		return false, err
+	}
+	var body bytes.Buffer
+	if err := writeMarkdownBody(&body, bookmark); err != nil {
+		return false, err
+	}
+	buf.WriteString(escapeHugoShortcodes(body.String()))
+	return true, writeFileAtomic(outputFilePath, buf.Bytes(), 0644)
+}
+
+// hugoShortcodePattern matches complete {{< … >}} and {{% … %}} shortcodes.
+var hugoShortcodePattern = regexp.MustCompile(`(?s)\{\{<.*?>\}\}|\{\{%.*?%\}\}`)
+
+// escapeHugoShortcodes comments out the shortcodes in a bookmark, so Hugo
+// shows them as written instead of calling them. Delimiters which aren't
+// part of a complete shortcode, like a lone >}} in a code sample, are left
+// alone.
+func escapeHugoShortcodes(s string) string {
+	return hugoShortcodePattern.ReplaceAllStringFunc(s, func(shortcode string) string {
+		start, inner, end := shortcode[:3], shortcode[3:len(shortcode)-3], shortcode[len(shortcode)-3:]
+		return start + "/*" + inner + "*/" + end
+	})
+}
+
+func (w hugoOutputWriter) writeFrontMatter(buf *bytes.Buffer, frontMatter interface{}) error {
+	if w.FrontMatter == hugoFrontMatterYAML {
+		data, err := yaml.Marshal(frontMatter)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+		buf.WriteString("---\n")
+		return nil
+	}
+	buf.WriteString("+++\n")
+	if err := toml.NewEncoder(buf).Encode(frontMatter); err != nil {
+		return err
+	}
+	buf.WriteString("+++\n")
+	return nil
+}
+
+func (w hugoOutputWriter) writeTextResource(bundleDir string, bookmark bookmarkData, changed bool) (bool, error) {
+	if len(bookmark.FullText) == 0 {
+		return false, nil
+	}
+	outputFilePath := filepath.Join(bundleDir, "mirror.html")
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
+	}
+	fullText, err := localizeAssets(bookmark, w.archiveDir(), bundleDir, "")
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(outputFilePath, []byte(fullText), 0644)
+}
+
+func (w hugoOutputWriter) writeHighlightsResource(bundleDir string, bookmark bookmarkData, changed bool) (bool, error) {
+	outputFilePath := filepath.Join(bundleDir, "highlights.json")
+	if len(bookmark.Highlights) == 0 {
+		return false, removeDeletedHighlights(outputFilePath, bookmark)
+	}
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
+	}
+	data, err := json.MarshalIndent(bookmark.Highlights, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(outputFilePath, data, 0644)
+}
+
+// writeFolderPage writes the term page for the bookmark's folder, so it has
+// a title, if there isn't one already.
+func (w hugoOutputWriter) writeFolderPage(bookmark bookmarkData) (bool, error) {
+	slug := hugoURLize(bookmark.ContainingFolder)
+	if slug == "" {
+		return false, nil
+	}
+	termDir := filepath.Join(w.Directory, "content", "folders", slug)
+	outputFilePath := filepath.Join(termDir, "_index.md")
+	if fileExists(outputFilePath) {
+		return false, nil
+	}
+	if err := os.MkdirAll(termDir, 0755); err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	if err := w.writeFrontMatter(&buf, struct {
+		Title string `toml:"title" yaml:"title"`
+	}{bookmark.ContainingFolder}); err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(outputFilePath, buf.Bytes(), 0644)
+}
+
+func newHugoFrontMatter(bookmark bookmarkData) hugoFrontMatter {
+	data := newPostData(bookmark)
+	frontMatter := hugoFrontMatter{
+		Title:       data.Title,
+		Date:        data.Saved,
+		Description: data.Description,
+		Tags:        data.Tags,
+		Params: hugoPageParams{
+			ArchiveID:      data.ID,
+			URL:            data.URL,
+			Starred:        data.Starred,
+			Progress:       data.Progress,
+			HighlightCount: len(data.Highlights),
+		},
+	}
+	if frontMatter.Date.IsZero() {
+		frontMatter.Date = data.Date
+	}
+	if data.Folder != "" {
+		frontMatter.Folders = []string{data.Folder}
+	}
+	return frontMatter
+}
+
+// hugoURLize returns the path Hugo uses for a taxonomy term, following the
+// rules of its urlize function: spaces become hyphens, anything but letters,
+// digits, marks and a few punctuation characters is dropped, and the result
+// is lowercased. Unlike Hugo, path separators are dropped too, so each term
+// is a single directory.
+func hugoURLize(s string) string {
+	var b strings.Builder
+	hyphen, wasHyphen := false, false
+	for i, r := range s {
+		if hugoAllowedPathRune(s, i, r) {
+			wasHyphen = r == '-'
+			if hyphen && !wasHyphen {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+		} else if b.Len() > 0 && !wasHyphen && unicode.IsSpace(r) {
+			hyphen = true
+		}
+	}
+	slug := strings.ToLower(b.String())
+	if slug == "." || slug == ".." {
+		return ""
+	}
+	return slug
+}
+
+func hugoAllowedPathRune(s string, i int, r rune) bool {
+	if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) {
+		return true
+	}
+	switch r {
+	case '.', '_', '#', '+', '~', '-', '@':
+		return true
+	case '%':
+		return i+2 < len(s) && isHexDigit(s[i+1]) && isHexDigit(s[i+2])
+	}
+	return false
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ochronus/instapaper-go-client/instapaper"
+	"gopkg.in/yaml.v3"
+)
+
+var hugoOutputWriterTestDir = filepath.Join("tmp", "hugoOutputWriter")
+
+func readTestHugoPage(t *testing.T, path, delimiter string) (string, string) {
+	t.Helper()
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read page: %v", err)
+	}
+	parts := strings.SplitN(string(contents), delimiter+"\n", 3)
+	if len(parts) != 3 || parts[0] != "" {
+		t.Fatalf("page %q has no %s front matter:\n%s", path, delimiter, contents)
+	}
+	return parts[1], parts[2]
+}
+
+func TestHugoOutputWriter_Write(t *testing.T) {
+	for _, format := range []string{hugoFrontMatterTOML, hugoFrontMatterYAML} {
+		t.Run(format, func(t *testing.T) {
+			w := hugoOutputWriter{Directory: hugoOutputWriterTestDir, FrontMatter: format}
+			if err := w.Preflight(); err != nil {
+				t.Fatalf("preflight failed: %v", err)
+			}
+			defer cleanupTestTmpDir(hugoOutputWriterTestDir)
+			bookmark := newTestBookmark(1234, "<p>Some <em>full</em> text with a {{< shortcode >}}</p>")
+			bookmark.Bookmark.Title = `Title: for the "bookmark"`
+			bookmark.Bookmark.Progress = 0.5
+			bookmark.Bookmark.Starred = "1"
+			bookmark.Highlights = []instapaper.Highlight{{ID: 1, BookmarkID: 1234, Text: "Some {{% full %}} text"}}
+			bookmark.ContainingFolder = "Books To Read"
+			if err := w.Write(bookmark); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			bundleDir := filepath.Join(w.Directory, "content", "bookmarks", "2010-11-01-1234")
+			delimiter := "+++"
+			unmarshal := toml.Unmarshal
+			if format == hugoFrontMatterYAML {
+				delimiter = "---"
+				unmarshal = yaml.Unmarshal
+			}
+			frontMatter, body := readTestHugoPage(t, filepath.Join(bundleDir, "index.md"), delimiter)
+			var actual hugoFrontMatter
+			if err := unmarshal([]byte(frontMatter), &actual); err != nil {
+				t.Fatalf("unable to parse front matter: %v\n%s", err, frontMatter)
+			}
+			expected := hugoFrontMatter{
+				Title:   bookmark.Bookmark.Title,
+				Date:    time.Unix(int64(bookmark.Bookmark.Time), 0).UTC(),
+				Folders: []string{"Books To Read"},
+				Params: hugoPageParams{
+					ArchiveID:      "1234",
+					URL:            "https://example.com/bookmark1234",
+					Starred:        true,
+					Progress:       0.5,
+					HighlightCount: 1,
+				},
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected front matter %+v, got %+v", expected, actual)
+			}
+			// Shortcodes in the text and highlights are shown, not called.
+			if !strings.Contains(body, "Some _full_ text with a {{</* shortcode */>}}") || !strings.Contains(body, "> Some {{%/* full */%}} text") {
+				t.Errorf("expected the text and highlights in the body, got:\n%s", body)
+			}
+
+			fileContentsMatch(t, filepath.Join(bundleDir, "mirror.html"), bookmark.FullText)
+			fileContentsMatch(t, filepath.Join(bundleDir, "highlights.json"), `"Text": "Some {{% full %}} text"`)
+			fileContentsMatch(t, filepath.Join(w.Directory, "data", "bookmarks", "1234.json"), `"ContainingFolder": "Books To Read"`)
+
+			folderFrontMatter, _ := readTestHugoPage(t, filepath.Join(w.Directory, "content", "folders", "books-to-read", "_index.md"), delimiter)
+			var folder struct {
+				Title string `toml:"title" yaml:"title"`
+			}
+			if err := unmarshal([]byte(folderFrontMatter), &folder); err != nil {
+				t.Fatalf("unable to parse folder front matter: %v", err)
+			}
+			if folder.Title != "Books To Read" {
+				t.Errorf("expected folder title %q, got %q", "Books To Read", folder.Title)
+			}
+
+			var taxonomies map[string]string
+			config, err := ioutil.ReadFile(filepath.Join(w.Directory, "config", "_default", "taxonomies."+format))
+			if err != nil {
+				t.Fatalf("unable to read taxonomy config: %v", err)
+			}
+			if err := unmarshal(config, &taxonomies); err != nil {
+				t.Fatalf("unable to parse taxonomy config: %v", err)
+			}
+			if !reflect.DeepEqual(taxonomies, hugoTaxonomies) {
+				t.Errorf("expected taxonomies %v, got %v", hugoTaxonomies, taxonomies)
+			}
+		})
+	}
+}
+
+func TestHugoOutputWriter_PreflightRejectsUnknownFrontMatter(t *testing.T) {
+	w := hugoOutputWriter{Directory: hugoOutputWriterTestDir, FrontMatter: "json"}
+	if err := w.Preflight(); err == nil {
+		t.Error("expected an error for an unsupported front matter format")
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"Books To Read":  "books-to-read",
+		"  Go & Rust!! ": "go-rust",
+		"Déjà vu":        "déjà-vu",
+		"":               "",
+	}
+	for input, expected := range tests {
+		if actual := slugify(input); actual != expected {
+			t.Errorf("slugify(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestHugoURLize(t *testing.T) {
+	tests := map[string]string{
+		"Books To Read":  "books-to-read",
+		"  Go & Rust!! ": "go-rust",
+		"Déjà vu":        "déjà-vu",
+		"C++ / Go":       "c++-go",
+		"Read-Later":     "read-later",
+		"100%":           "100",
+		"a%2Fb":          "a%2fb",
+		"../..":          "....",
+		"..":             "",
+		"":               "",
+	}
+	for input, expected := range tests {
+		if actual := hugoURLize(input); actual != expected {
+			t.Errorf("hugoURLize(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestEscapeHugoShortcodes(t *testing.T) {
+	for input, expected := range map[string]string{
+		"a {{< shortcode >}} b":                "a {{</* shortcode */>}} b",
+		"{{% note %}}text{{% /note %}}":        "{{%/* note */%}}text{{%/* /note */%}}",
+		"{{< multi\nline >}}":                  "{{</* multi\nline */>}}",
+		"if a >}} b { return }":                "if a >}} b { return }",
+		"{{< unclosed":                         "{{< unclosed",
+		"50%}} and x >}} but not {{< y >}}":    "50%}} and x >}} but not {{</* y */>}}",
+		"template: {{ .Title }} and {{- x -}}": "template: {{ .Title }} and {{- x -}}",
+	} {
+		if actual := escapeHugoShortcodes(input); actual != expected {
+			t.Errorf("escapeHugoShortcodes(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
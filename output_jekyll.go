@@ -5,14 +5,66 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
 )
 
+// jekyllAssetsDir is where mirrored images are copied to in the site. Jekyll
+// doesn't publish directories starting with an underscore, like _assets.
+const jekyllAssetsDir = "assets/mirrored"
+
 type jekyllOutputWriter struct {
 	Directory string
+	// ArchiveDirectory is where mirrored images are copied from. If empty,
+	// it's Directory.
+	ArchiveDirectory string
+	// BaseURL is the site's baseurl, which posts link to mirrored images
+	// under, since their permalinks could be anywhere in the site.
+	BaseURL string
+	// Force rewrites every file, regardless of what the manifest says.
+	Force bool
+	// Manifest records what was last written for each bookmark so only the
+	// files whose inputs changed are rewritten. If nil, existing files are
+	// never rewritten.
+	Manifest *syncManifest
+	// Progress is told how many files were written for each bookmark.
+	Progress *progressReporter
+	// PostTemplate renders each post from a postData. If nil,
+	// defaultJekyllPostTemplate is used.
+	PostTemplate *template.Template
+	// PostExtension is the extension of each post, e.g. "md". If empty,
+	// posts are written as HTML.
+	PostExtension string
+}
+
+// jekyllBaseURL returns the baseurl in the _config.yml in directory, if any.
+func jekyllBaseURL(directory string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(directory, "_config.yml"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		BaseURL string `yaml:"baseurl"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("error reading _config.yml: %v", err)
+	}
+	return strings.TrimSuffix(config.BaseURL, "/"), nil
+}
+
+func (w jekyllOutputWriter) archiveDir() string {
+	if w.ArchiveDirectory != "" {
+		return w.ArchiveDirectory
+	}
+	return w.Directory
 }
 
 func (w jekyllOutputWriter) Preflight() error {
@@ -28,85 +80,134 @@ func (w jekyllOutputWriter) Preflight() error {
 	if err := os.MkdirAll(w.Directory+"/_mirror", 0755); err != nil {
 		return err
 	}
-	return nil
+	for _, dir := range []string{w.Directory, w.Directory + "/_posts", w.Directory + "/_data", w.Directory + "/_mirror"} {
+		if err := removeAtomicWriteTempFiles(dir); err != nil {
+			return err
+		}
+	}
+	return w.Manifest.Load()
 }
 
 func (w jekyllOutputWriter) Write(bookmark bookmarkData) error {
-	if err := w.writeJSONFile(bookmark); err != nil {
-		log.Printf("[%s] error writing JSON: %v", bookmark.GetID(), err)
+	files, err := w.writeFiles(bookmark)
+	if err != nil {
 		return err
 	}
-	if err := w.writeJekyllPost(bookmark); err != nil {
-		log.Printf("[%s] error writing jekyll post: %v", bookmark.GetID(), err)
-		return err
+	w.Progress.BookmarkWritten(files)
+	return nil
+}
+
+// writeFiles writes the bookmark, returning how many files it wrote.
+func (w jekyllOutputWriter) writeFiles(bookmark bookmarkData) (int, error) {
+	changes := w.Manifest.Changes(bookmark)
+	if w.Force {
+		changes = allSyncManifestChanges
+	}
+	filesWritten := 0
+	written, err := w.writeJSONFile(bookmark, changes.Metadata)
+	if err != nil {
+		slog.Error("error writing JSON", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
 	}
-	if err := w.writeTextFile(bookmark); err != nil {
-		log.Printf("[%s] error writing text: %v", bookmark.GetID(), err)
-		return err
+	if written {
+		filesWritten++
 	}
-	if err := w.writeHighlightsFile(bookmark); err != nil {
-		log.Printf("[%s] error writing highlights: %v", bookmark.GetID(), err)
-		return err
+	written, err = w.writeJekyllPost(bookmark, changes.Post)
+	if err != nil {
+		slog.Error("error writing jekyll post", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
 	}
-	return nil
+	if written {
+		filesWritten++
+	}
+	written, err = w.writeTextFile(bookmark, changes.FullText)
+	if err != nil {
+		slog.Error("error writing text", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
+	}
+	if written {
+		filesWritten++
+	}
+	written, err = w.writeHighlightsFile(bookmark, changes.Highlights)
+	if err != nil {
+		slog.Error("error writing highlights", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
+	}
+	if written {
+		filesWritten++
+	}
+	w.Manifest.Update(bookmark)
+	return filesWritten, nil
 }
 
-func (w jekyllOutputWriter) writeJSONFile(bookmark bookmarkData) error {
+func (w jekyllOutputWriter) Close() error {
+	return w.Manifest.Save()
+}
+
+func (w jekyllOutputWriter) writeJSONFile(bookmark bookmarkData, changed bool) (bool, error) {
 	outputFilePath := filepath.Join(w.Directory, "_data", fmt.Sprintf("%s.json", bookmark.GetID()))
-	if fileExists(outputFilePath) {
-		return nil
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
 	}
 	data, err := json.MarshalIndent(bookmark, "", "  ")
 	if err != nil {
-		return err
+		return false, err
 	}
-	return ioutil.WriteFile(outputFilePath, data, 0644)
+	return true, writeFileAtomic(outputFilePath, data, 0644)
 }
 
-func (w jekyllOutputWriter) writeJekyllPost(bookmark bookmarkData) error {
-	outputFilePath := filepath.Join(w.Directory, "_posts", fmt.Sprintf("%s-%s.html", bookmark.GetYYYYMMDD(), bookmark.GetID()))
-	if fileExists(outputFilePath) {
-		return nil
+func (w jekyllOutputWriter) writeJekyllPost(bookmark bookmarkData, changed bool) (bool, error) {
+	extension := strings.TrimPrefix(w.PostExtension, ".")
+	if extension == "" {
+		extension = "html"
+	}
+	outputFilePath := filepath.Join(w.Directory, "_posts", fmt.Sprintf("%s-%s.%s", bookmark.GetYYYYMMDD(), bookmark.GetID(), extension))
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
+	}
+	fullText, err := localizeAssets(bookmark, w.archiveDir(), filepath.Join(w.Directory, filepath.FromSlash(jekyllAssetsDir)), w.BaseURL+"/"+jekyllAssetsDir+"/")
+	if err != nil {
+		return false, err
+	}
+	bookmark.FullText = fullText
+	tmpl := w.PostTemplate
+	if tmpl == nil {
+		tmpl = defaultJekyllPostTemplateParsed
 	}
 	var buf bytes.Buffer
-	buf.WriteString("---\n")
-	buf.WriteString("archive_id: \"" + bookmark.GetID() + "\"\n")
-	buf.WriteString("title: \"" + strings.ReplaceAll(bookmark.GetTitle(), `"`, `\"`) + "\"\n")
-	buf.WriteString("category: \"" + bookmark.ContainingFolder + "\"\n")
-	buf.WriteString("---\n\n")
-	if len(bookmark.FullText) > 0 {
-		buf.WriteString("{% raw %}\n")
-		buf.WriteString(bookmark.FullText)
-		buf.WriteString("\n")
-		buf.WriteString("{% endraw %}\n")
-	}
-	return ioutil.WriteFile(outputFilePath, buf.Bytes(), 0644)
+	if err := tmpl.Execute(&buf, newPostData(bookmark)); err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(outputFilePath, buf.Bytes(), 0644)
 }
 
-func (w jekyllOutputWriter) writeTextFile(bookmark bookmarkData) error {
+func (w jekyllOutputWriter) writeTextFile(bookmark bookmarkData, changed bool) (bool, error) {
 	if len(bookmark.FullText) == 0 {
-		return nil
+		return false, nil
 	}
 
 	outputFilePath := filepath.Join(w.Directory, "_mirror", fmt.Sprintf("%s.html", bookmark.GetID()))
-	if fileExists(outputFilePath) {
-		return nil
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
 	}
-	return ioutil.WriteFile(outputFilePath, []byte(bookmark.FullText), 0644)
+	fullText, err := localizeAssets(bookmark, w.archiveDir(), filepath.Join(w.Directory, filepath.FromSlash(jekyllAssetsDir)), "../"+jekyllAssetsDir+"/")
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(outputFilePath, []byte(fullText), 0644)
 }
 
-func (w jekyllOutputWriter) writeHighlightsFile(bookmark bookmarkData) error {
+func (w jekyllOutputWriter) writeHighlightsFile(bookmark bookmarkData, changed bool) (bool, error) {
+	outputFilePath := filepath.Join(w.Directory, "_data", fmt.Sprintf("%s.highlights.json", bookmark.GetID()))
 	if len(bookmark.Highlights) <= 0 {
-		return nil // no highlights
+		return false, removeDeletedHighlights(outputFilePath, bookmark)
 	}
-
-	outputFilePath := filepath.Join(w.Directory, "_data", fmt.Sprintf("%s.highlights.json", bookmark.GetID()))
-	if fileExists(outputFilePath) {
-		return nil
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
 	}
 	data, err := json.MarshalIndent(bookmark.Highlights, "", "  ")
 	if err != nil {
-		return err
+		return false, err
 	}
-	return ioutil.WriteFile(outputFilePath, data, 0644)
+	return true, writeFileAtomic(outputFilePath, data, 0644)
 }
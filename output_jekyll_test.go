@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -85,6 +86,158 @@ func TestJekyllOutputWriter_Write(t *testing.T) {
 	fileContentsMatch(t, filepath.Join(w.Directory, "_data", "1234.highlights.json"), `"Text": "Text of the highlight",`)
 	fileContentsMatch(t, filepath.Join(w.Directory, "_mirror", "1234.html"), "full text\n\nof an article")
 	fileContentsMatch(t, filepath.Join(w.Directory, "_posts", "2010-11-01-1234.html"), `archive_id: "1234"`)
-	fileContentsMatch(t, filepath.Join(w.Directory, "_posts", "2010-11-01-1234.html"), `category: "Books To Read"`)
+	fileContentsMatch(t, filepath.Join(w.Directory, "_posts", "2010-11-01-1234.html"), "category: Books To Read\n")
 	fileContentsMatch(t, filepath.Join(w.Directory, "_posts", "2010-11-01-1234.html"), "{% raw %}\nfull text\n\nof an article")
 }
+
+func TestJekyllOutputWriter_WriteWithManifest(t *testing.T) {
+	newWriter := func() jekyllOutputWriter {
+		return jekyllOutputWriter{
+			Directory: jekyllOutputWriterTestDir,
+			Manifest:  newSyncManifest(filepath.Join(jekyllOutputWriterTestDir, syncManifestFileName)),
+		}
+	}
+	w := newWriter()
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(jekyllOutputWriterTestDir)
+	bookmark := bookmarkData{
+		Bookmark: &instapaper.Bookmark{
+			Hash:  "hash1234",
+			ID:    1234,
+			Title: "Title for the bookmark",
+			URL:   "https://example.com/bookmark1234",
+			Time:  1288608076,
+		},
+		FullText:         "full text",
+		ContainingFolder: "unread",
+	}
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// Unchanged bookmarks are left alone.
+	mirrorPath := filepath.Join(w.Directory, "_mirror", "1234.html")
+	if err := ioutil.WriteFile(mirrorPath, []byte("edited by hand"), 0644); err != nil {
+		t.Fatalf("unable to edit mirror: %v", err)
+	}
+	w = newWriter()
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, mirrorPath, "edited by hand")
+
+	// Changed bookmarks are rewritten, but a missing full text doesn't clobber
+	// the archived one.
+	bookmark.ContainingFolder = "archive"
+	bookmark.FullText = ""
+	bookmark.Highlights = []instapaper.Highlight{{ID: 1, BookmarkID: 1234, Text: "A new highlight"}}
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	postPath := filepath.Join(w.Directory, "_posts", "2010-11-01-1234.html")
+	fileContentsMatch(t, filepath.Join(w.Directory, "_data", "1234.json"), `"ContainingFolder": "archive"`)
+	fileContentsMatch(t, filepath.Join(w.Directory, "_data", "1234.highlights.json"), `"Text": "A new highlight"`)
+	fileContentsMatch(t, postPath, "category: unread\n")
+	fileContentsMatch(t, mirrorPath, "edited by hand")
+
+	// The post catches up once the same text is fetched again.
+	bookmark.FullText = "full text"
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, postPath, "category: archive\n")
+	fileContentsMatch(t, mirrorPath, "edited by hand")
+
+	bookmark.FullText = "updated full text"
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, postPath, "category: archive\n")
+	fileContentsMatch(t, postPath, "updated full text")
+	fileContentsMatch(t, mirrorPath, "updated full text")
+
+	// Highlights which weren't fetched are kept, but deleted ones are removed.
+	highlightsPath := filepath.Join(w.Directory, "_data", "1234.highlights.json")
+	bookmark.Highlights = nil
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, highlightsPath, `"Text": "A new highlight"`)
+	fileContentsMatch(t, postPath, "highlight_count: 1\n")
+	bookmark.HighlightsFetched = true
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if fileExists(highlightsPath) {
+		t.Errorf("expected deleted highlights to be removed")
+	}
+	fileContentsMatch(t, postPath, "highlight_count: 0\n")
+
+	// Force rewrites everything.
+	if err := ioutil.WriteFile(mirrorPath, []byte("edited by hand"), 0644); err != nil {
+		t.Fatalf("unable to edit mirror: %v", err)
+	}
+	w.Force = true
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, mirrorPath, "updated full text")
+}
+
+func TestJekyllOutputWriter_RecoversFromInterruptedWrite(t *testing.T) {
+	w := jekyllOutputWriter{Directory: jekyllOutputWriterTestDir}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(jekyllOutputWriterTestDir)
+
+	// Simulate a process which died while writing the post: the temporary
+	// file is left behind, but the post itself was never created.
+	tempFile := filepath.Join(w.Directory, "_posts", ".tmp-12345")
+	if err := ioutil.WriteFile(tempFile, []byte("---\narchive_id: \"1234\"\nti"), 0644); err != nil {
+		t.Fatalf("unable to write temp file: %v", err)
+	}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	if fileExists(tempFile) {
+		t.Fatalf("expected preflight to remove %q", tempFile)
+	}
+
+	bookmark := bookmarkData{
+		Bookmark: &instapaper.Bookmark{ID: 1234, Title: "Title for the bookmark", URL: "https://example.com/bookmark1234", Time: 1288608076},
+		FullText: "full text",
+	}
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, filepath.Join(w.Directory, "_posts", "2010-11-01-1234.html"), "{% raw %}\nfull text\n{% endraw %}\n")
+	for _, dir := range []string{"_posts", "_data", "_mirror"} {
+		assertNoAtomicWriteTempFiles(t, filepath.Join(w.Directory, dir))
+	}
+}
+
+func TestJekyllBaseURL(t *testing.T) {
+	defer cleanupTestTmpDir(jekyllOutputWriterTestDir)
+	directory := jekyllOutputWriterTestDir
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		t.Fatalf("unable to create %s: %v", directory, err)
+	}
+	if baseURL, err := jekyllBaseURL(directory); err != nil || baseURL != "" {
+		t.Errorf("expected no baseurl without a config, got %q, %v", baseURL, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(directory, "_config.yml"), []byte("title: Reading\nbaseurl: /reading/\n"), 0644); err != nil {
+		t.Fatalf("unable to write config: %v", err)
+	}
+	if baseURL, err := jekyllBaseURL(directory); err != nil || baseURL != "/reading" {
+		t.Errorf("expected baseurl /reading, got %q, %v", baseURL, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type markdownOutputWriter struct {
+	Directory string
+	// ArchiveDirectory is where mirrored images are copied from, into
+	// Directory's assets directory. If empty, it's Directory.
+	ArchiveDirectory string
+	// Force rewrites every file, regardless of what the manifest says.
+	Force bool
+	// Manifest records what was last written for each bookmark so only the
+	// files whose inputs changed are rewritten. If nil, existing files are
+	// never rewritten.
+	Manifest *syncManifest
+	// Progress is told how many files were written for each bookmark.
+	Progress *progressReporter
+}
+
+func (w markdownOutputWriter) archiveDir() string {
+	if w.ArchiveDirectory != "" {
+		return w.ArchiveDirectory
+	}
+	return w.Directory
+}
+
+func (w markdownOutputWriter) Preflight() error {
+	if err := os.MkdirAll(w.Directory, 0755); err != nil {
+		return err
+	}
+	if err := removeAtomicWriteTempFiles(w.Directory); err != nil {
+		return err
+	}
+	return w.Manifest.Load()
+}
+
+func (w markdownOutputWriter) Write(bookmark bookmarkData) error {
+	files, err := w.writeFiles(bookmark)
+	if err != nil {
+		return err
+	}
+	w.Progress.BookmarkWritten(files)
+	return nil
+}
+
+// writeFiles writes the bookmark, returning how many files it wrote.
+func (w markdownOutputWriter) writeFiles(bookmark bookmarkData) (int, error) {
+	changes := w.Manifest.Changes(bookmark)
+	// Post covers the metadata and highlights too, but holds them back
+	// while the full text is missing, so the body isn't lost.
+	changed := w.Force || changes.Post
+	written, err := w.writeMarkdownFile(bookmark, changed)
+	if err != nil {
+		slog.Error("error writing markdown", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
+	}
+	w.Manifest.Update(bookmark)
+	filesWritten := 0
+	if written {
+		filesWritten = 1
+	}
+	return filesWritten, nil
+}
+
+func (w markdownOutputWriter) Close() error {
+	return w.Manifest.Save()
+}
+
+func (w markdownOutputWriter) writeMarkdownFile(bookmark bookmarkData, changed bool) (bool, error) {
+	outputFilePath := filepath.Join(w.Directory, fmt.Sprintf("%s-%s.md", bookmark.GetYYYYMMDD(), bookmark.GetID()))
+	if !changed && fileExists(outputFilePath) {
+		return false, nil
+	}
+	fullText, err := localizeAssets(bookmark, w.archiveDir(), filepath.Join(w.Directory, "assets"), "assets/")
+	if err != nil {
+		return false, err
+	}
+	bookmark.FullText = fullText
+	data, err := renderMarkdown(bookmark)
+	if err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(outputFilePath, data, 0644)
+}
+
+// markdownFrontMatter is the YAML front matter of a Markdown file.
+type markdownFrontMatter struct {
+	ID     string `yaml:"id"`
+	URL    string `yaml:"url"`
+	Title  string `yaml:"title"`
+	Folder string `yaml:"folder"`
+	// Saved is a plain YYYY-MM-DD date rather than a full timestamp.
+	Saved    *yaml.Node `yaml:"saved"`
+	Progress float32    `yaml:"progress"`
+	Starred  bool       `yaml:"starred"`
+}
+
+func renderMarkdown(bookmark bookmarkData) ([]byte, error) {
+	frontMatter := markdownFrontMatter{
+		ID:     bookmark.GetID(),
+		URL:    bookmark.GetURL(),
+		Title:  bookmark.GetTitle(),
+		Folder: bookmark.ContainingFolder,
+		Saved:  &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!timestamp", Value: bookmark.GetYYYYMMDD()},
+	}
+	if bookmark.Bookmark != nil {
+		frontMatter.Progress = bookmark.Bookmark.Progress
+		frontMatter.Starred = bookmark.Bookmark.Starred == "1"
+	}
+	data, err := yaml.Marshal(frontMatter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode front matter: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	buf.Write(data)
+	buf.WriteString("---\n\n")
+	buf.WriteString("# " + strings.Join(strings.Fields(bookmark.GetTitle()), " ") + "\n")
+	if err := writeMarkdownBody(&buf, bookmark); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMarkdownBody writes the bookmark's full text and highlights to buf as
+// Markdown, each preceded by a blank line.
+func writeMarkdownBody(buf *bytes.Buffer, bookmark bookmarkData) error {
+	if len(bookmark.FullText) > 0 {
+		body, err := htmlToMarkdown(bookmark.FullText)
+		if err != nil {
+			return err
+		}
+		if body != "" {
+			buf.WriteString("\n" + body + "\n")
+		}
+	}
+
+	if len(bookmark.Highlights) > 0 {
+		buf.WriteString("\n## Highlights\n")
+		for _, highlight := range bookmark.Highlights {
+			buf.WriteString("\n" + markdownPrefixLines(strings.TrimSpace(highlight.Text), "> ", ">") + "\n")
+			if note := strings.TrimSpace(highlight.Note); note != "" {
+				buf.WriteString("\n" + markdownPrefixLines("**Note:** "+note, "> ", ">") + "\n")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var markdownOutputWriterTestDir = filepath.Join("tmp", "markdownOutputWriter")
+
+func goldenFileMatches(t *testing.T, path, goldenPath string) {
+	actual, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read file: %v", err)
+	}
+	expected, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("unable to read golden file: %v", err)
+	}
+	if string(actual) != string(expected) {
+		t.Fatalf("file %q does not match %q:\n\n%s\n---", path, goldenPath, string(actual))
+	}
+}
+
+func TestMarkdownOutputWriter_Preflight(t *testing.T) {
+	w := markdownOutputWriter{Directory: markdownOutputWriterTestDir}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(markdownOutputWriterTestDir)
+}
+
+func TestMarkdownOutputWriter_Write(t *testing.T) {
+	w := markdownOutputWriter{Directory: markdownOutputWriterTestDir}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(markdownOutputWriterTestDir)
+	bookmark := bookmarkData{
+		Bookmark: &instapaper.Bookmark{
+			Hash:     "hash1234",
+			ID:       1234,
+			Title:    `Title: for the "bookmark"`,
+			URL:      "https://example.com/bookmark1234",
+			Time:     1288608076,
+			Progress: 0.5,
+			Starred:  "1",
+		},
+		FullText: `<html><head><title>Ignored</title><script>alert("no")</script></head><body>
+<h1>A heading</h1>
+<p>Some <strong>bold</strong> and <em>emphasized</em> text with a <a href="https://example.com/link">link</a>
+and a literal *asterisk*.</p>
+<ul><li>First</li><li>Second<ol><li>Nested</li></ol></li></ul>
+<blockquote><p>A quote</p><p>spanning paragraphs</p></blockquote>
+<pre><code>func main() {
+	fmt.Println("hi")
+}</code></pre>
+<p><img src="https://example.com/image.png" alt="An image"><br>After the break, <code>inline code</code>.</p>
+</body></html>`,
+		Highlights: []instapaper.Highlight{
+			{ID: 1, BookmarkID: 1234, Text: "Some bold and emphasized text", Note: "Note for highlight\n\nspanning lines"},
+			{ID: 2, BookmarkID: 1234, Text: "A quote"},
+		},
+		ContainingFolder: "Books To Read",
+	}
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	goldenFileMatches(t, filepath.Join(w.Directory, "2010-11-01-1234.md"), filepath.Join("testdata", "markdown", "2010-11-01-1234.md"))
+}
+
+func TestMarkdownOutputWriter_WriteWithoutText(t *testing.T) {
+	w := markdownOutputWriter{Directory: markdownOutputWriterTestDir}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(markdownOutputWriterTestDir)
+	bookmark := bookmarkData{
+		BookmarkExportMeta: &bookmarkExportMeta{
+			URL:       "https://example.com/from-csv",
+			Title:     "From the CSV",
+			Timestamp: "1288608076",
+		},
+		ContainingFolder: "Unread",
+	}
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	goldenFileMatches(t, filepath.Join(w.Directory, "2010-11-01-sha-aa511dbe28.md"), filepath.Join("testdata", "markdown", "2010-11-01-sha-aa511dbe28.md"))
+}
+
+func TestMarkdownOutputWriter_WriteWithManifest(t *testing.T) {
+	w := markdownOutputWriter{
+		Directory: markdownOutputWriterTestDir,
+		Manifest:  newSyncManifest(filepath.Join(markdownOutputWriterTestDir, syncManifestFileName)),
+	}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(markdownOutputWriterTestDir)
+	bookmark := newTestBookmark(1234, "<p>full text</p>")
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	path := filepath.Join(w.Directory, "2010-11-01-1234.md")
+
+	// Moving the bookmark while its text couldn't be fetched keeps the body.
+	bookmark.ContainingFolder = "Archive"
+	bookmark.FullText = ""
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, path, "full text")
+	fileContentsMatch(t, path, "folder: Unread\n")
+
+	// The same text fetched again brings the file up to date.
+	bookmark.FullText = "<p>full text</p>"
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fileContentsMatch(t, path, "full text")
+	fileContentsMatch(t, path, "folder: Archive\n")
+}
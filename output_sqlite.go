@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order when the database is opened, and
+// PRAGMA user_version records how many have been applied. Only ever append
+// to this list.
+var sqliteMigrations = []string{
+	`CREATE TABLE folders (
+		name TEXT PRIMARY KEY
+	);
+	CREATE TABLE bookmarks (
+		id TEXT PRIMARY KEY,
+		instapaper_id INTEGER,
+		hash TEXT NOT NULL,
+		url TEXT NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		selection TEXT NOT NULL DEFAULT '',
+		folder TEXT REFERENCES folders(name),
+		saved_on TEXT NOT NULL,
+		progress REAL NOT NULL DEFAULT 0,
+		progress_timestamp INTEGER NOT NULL DEFAULT 0,
+		starred INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX bookmarks_folder ON bookmarks(folder);
+	CREATE INDEX bookmarks_saved_on ON bookmarks(saved_on);
+	CREATE TABLE highlights (
+		id INTEGER PRIMARY KEY,
+		bookmark_id TEXT NOT NULL REFERENCES bookmarks(id) ON DELETE CASCADE,
+		text TEXT NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL DEFAULT 0,
+		time TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX highlights_bookmark_id ON highlights(bookmark_id);
+	CREATE TABLE full_texts (
+		bookmark_id TEXT PRIMARY KEY REFERENCES bookmarks(id) ON DELETE CASCADE,
+		html TEXT NOT NULL
+	);
+	CREATE VIRTUAL TABLE full_text_search USING fts5(bookmark_id UNINDEXED, title, text);`,
+}
+
+type sqliteOutputWriter struct {
+	Path string
+
+	// The worker pool calls Write concurrently, but SQLite only supports
+	// one writer at a time.
+	mu sync.Mutex
+	db *sql.DB
+}
+
+func (w *sqliteOutputWriter) Preflight() error {
+	if err := os.MkdirAll(filepath.Dir(w.Path), 0755); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", w.Path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return err
+	}
+	w.db = db
+	return nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying migration %d: %v", i+1, err)
+		}
+		// PRAGMA doesn't support bound parameters.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *sqliteOutputWriter) Write(bookmark bookmarkData) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := w.writeBookmark(tx, bookmark); err != nil {
+		slog.Error("error writing to sqlite", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (w *sqliteOutputWriter) writeBookmark(tx *sql.Tx, bookmark bookmarkData) error {
+	var folder interface{}
+	if bookmark.ContainingFolder != "" {
+		folder = bookmark.ContainingFolder
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO folders (name) VALUES (?)`, folder); err != nil {
+			return err
+		}
+	}
+
+	var instapaperID interface{}
+	var description, selection string
+	var progress float32
+	var progressTimestamp int64
+	var starred bool
+	if bookmark.Bookmark != nil {
+		if bookmark.Bookmark.ID > 0 {
+			instapaperID = bookmark.Bookmark.ID
+		}
+		description = bookmark.Bookmark.Description
+		progress = bookmark.Bookmark.Progress
+		progressTimestamp = bookmark.Bookmark.ProgressTimestamp
+		starred = bookmark.Bookmark.Starred == "1"
+	}
+	if bookmark.BookmarkExportMeta != nil {
+		selection = bookmark.BookmarkExportMeta.Selection
+	}
+	duplicates, err := sqliteDuplicateIDs(tx, bookmark)
+	if err != nil {
+		return err
+	}
+	if instapaperID == nil {
+		for _, duplicate := range duplicates {
+			if duplicate.instapaperID.Valid {
+				// The bookmark is already stored under the API's ID, which
+				// has everything the export does.
+				return nil
+			}
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO bookmarks
+		(id, instapaper_id, hash, url, title, description, selection, folder, saved_on, progress, progress_timestamp, starred)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			instapaper_id = excluded.instapaper_id,
+			hash = excluded.hash,
+			url = excluded.url,
+			title = excluded.title,
+			description = excluded.description,
+			selection = excluded.selection,
+			folder = excluded.folder,
+			saved_on = excluded.saved_on,
+			progress = excluded.progress,
+			progress_timestamp = excluded.progress_timestamp,
+			starred = excluded.starred`,
+		bookmark.GetID(), instapaperID, bookmark.GetHash(), bookmark.GetURL(), bookmark.GetTitle(),
+		description, selection, folder, bookmark.GetYYYYMMDD(), progress, progressTimestamp, starred,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Missing full text or highlights usually mean we failed to fetch them
+	// this time, so keep whatever was stored before.
+	if len(bookmark.Highlights) > 0 || bookmark.HighlightsFetched {
+		if _, err := tx.Exec(`DELETE FROM highlights WHERE bookmark_id = ?`, bookmark.GetID()); err != nil {
+			return err
+		}
+		for _, highlight := range bookmark.Highlights {
+			_, err := tx.Exec(`INSERT OR REPLACE INTO highlights (id, bookmark_id, text, note, position, time) VALUES (?, ?, ?, ?, ?, ?)`,
+				highlight.ID, bookmark.GetID(), highlight.Text, highlight.Note, highlight.Position, highlight.Time.String())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(bookmark.FullText) > 0 {
+		_, err := tx.Exec(`INSERT INTO full_texts (bookmark_id, html) VALUES (?, ?)
+			ON CONFLICT (bookmark_id) DO UPDATE SET html = excluded.html`,
+			bookmark.GetID(), bookmark.FullText)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, duplicate := range duplicates {
+		if err := mergeSQLiteDuplicate(tx, duplicate.id, bookmark); err != nil {
+			return err
+		}
+	}
+
+	var html string
+	err = tx.QueryRow(`SELECT html FROM full_texts WHERE bookmark_id = ?`, bookmark.GetID()).Scan(&html)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	text, err := htmlToText(html)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM full_text_search WHERE bookmark_id = ?`, bookmark.GetID()); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO full_text_search (bookmark_id, title, text) VALUES (?, ?, ?)`,
+		bookmark.GetID(), bookmark.GetTitle(), text)
+	return err
+}
+
+// sqliteDuplicate is another row for the same bookmark, i.e. the same URL
+// stored from an export as well as the API.
+type sqliteDuplicate struct {
+	id           string
+	instapaperID sql.NullInt64
+}
+
+// sqliteDuplicateIDs returns the other rows stored for the bookmark's URL.
+func sqliteDuplicateIDs(tx *sql.Tx, bookmark bookmarkData) ([]sqliteDuplicate, error) {
+	rows, err := tx.Query(`SELECT id, instapaper_id FROM bookmarks WHERE url = ? AND id != ?`, bookmark.GetURL(), bookmark.GetID())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var duplicates []sqliteDuplicate
+	for rows.Next() {
+		var duplicate sqliteDuplicate
+		if err := rows.Scan(&duplicate.id, &duplicate.instapaperID); err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, duplicate)
+	}
+	return duplicates, rows.Err()
+}
+
+// mergeSQLiteDuplicate fills in what the bookmark is missing from the row
+// stored under id, then removes that row, as the bookmark store does.
+func mergeSQLiteDuplicate(tx *sql.Tx, id string, bookmark bookmarkData) error {
+	_, err := tx.Exec(`UPDATE bookmarks SET selection = (SELECT selection FROM bookmarks WHERE id = ?)
+		WHERE id = ? AND selection = ''`, id, bookmark.GetID())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR IGNORE INTO full_texts (bookmark_id, html)
+		SELECT ?, html FROM full_texts WHERE bookmark_id = ?`, bookmark.GetID(), id)
+	if err != nil {
+		return err
+	}
+	if len(bookmark.Highlights) == 0 && !bookmark.HighlightsFetched {
+		if _, err := tx.Exec(`UPDATE highlights SET bookmark_id = ? WHERE bookmark_id = ?`, bookmark.GetID(), id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM full_text_search WHERE bookmark_id = ?`, id); err != nil {
+		return err
+	}
+	// Its highlights and full text go with it.
+	_, err = tx.Exec(`DELETE FROM bookmarks WHERE id = ?`, id)
+	return err
+}
+
+func (w *sqliteOutputWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.db == nil {
+		return nil
+	}
+	return w.db.Close()
+}
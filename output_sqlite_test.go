@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var sqliteOutputWriterTestDir = filepath.Join("tmp", "sqliteOutputWriter")
+
+func querySQLiteInt(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("query %q failed: %v", query, err)
+	}
+	return n
+}
+
+func TestSQLiteOutputWriter_Preflight(t *testing.T) {
+	defer cleanupTestTmpDir(sqliteOutputWriterTestDir)
+	path := filepath.Join(sqliteOutputWriterTestDir, "instapaper.db")
+	for i := 0; i < 2; i++ {
+		w := &sqliteOutputWriter{Path: path}
+		if err := w.Preflight(); err != nil {
+			t.Fatalf("preflight %d failed: %v", i, err)
+		}
+		if version := querySQLiteInt(t, w.db, "PRAGMA user_version"); version != len(sqliteMigrations) {
+			t.Fatalf("expected user_version %d, got %d", len(sqliteMigrations), version)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+	}
+}
+
+func TestSQLiteOutputWriter_Write(t *testing.T) {
+	defer cleanupTestTmpDir(sqliteOutputWriterTestDir)
+	w := &sqliteOutputWriter{Path: filepath.Join(sqliteOutputWriterTestDir, "instapaper.db")}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer w.Close()
+	bookmark := bookmarkData{
+		Bookmark: &instapaper.Bookmark{
+			Hash:     "hash1234",
+			ID:       1234,
+			Title:    "Title for the bookmark",
+			URL:      "https://example.com/bookmark1234",
+			Time:     1288608076,
+			Progress: 0.5,
+			Starred:  "1",
+		},
+		FullText: "<p>full text of an <em>article</em> about gophers</p>",
+		Highlights: []instapaper.Highlight{
+			{ID: 92841, BookmarkID: 1234, Text: "Text of the highlight", Note: "Note for highlight"},
+		},
+		ContainingFolder: "Books To Read",
+	}
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	// Rewriting without text or highlights updates the metadata but keeps
+	// what was already stored.
+	bookmark.FullText = ""
+	bookmark.Highlights = nil
+	bookmark.ContainingFolder = "archive"
+	if err := w.Write(bookmark); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM bookmarks"); n != 1 {
+		t.Fatalf("expected 1 bookmark, got %d", n)
+	}
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM bookmarks WHERE id = '1234' AND folder = 'archive' AND starred = 1 AND saved_on = '2010-11-01'"); n != 1 {
+		t.Fatalf("expected bookmark metadata to be updated")
+	}
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM folders"); n != 2 {
+		t.Fatalf("expected 2 folders, got %d", n)
+	}
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM highlights WHERE bookmark_id = '1234' AND note = 'Note for highlight'"); n != 1 {
+		t.Fatalf("expected 1 highlight, got %d", n)
+	}
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM full_texts WHERE bookmark_id = '1234'"); n != 1 {
+		t.Fatalf("expected 1 full text, got %d", n)
+	}
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM full_text_search WHERE full_text_search MATCH ?", "gophers"); n != 1 {
+		t.Fatalf("expected full text search to match, got %d", n)
+	}
+}
+
+func TestSQLiteOutputWriter_MergesExportAndAPIBookmarks(t *testing.T) {
+	defer cleanupTestTmpDir(sqliteOutputWriterTestDir)
+	w := &sqliteOutputWriter{Path: filepath.Join(sqliteOutputWriterTestDir, "instapaper.db")}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer w.Close()
+	fromExport := bookmarkData{
+		BookmarkExportMeta: &bookmarkExportMeta{URL: "https://example.com/bookmark1234", Title: "From the export", Selection: "A selection", Timestamp: "1288608076"},
+		FullText:           "<p>captured text about gophers</p>",
+		ContainingFolder:   "Unread",
+	}
+	if err := w.Write(fromExport); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	fromAPI := newTestBookmark(1234, "")
+	if err := w.Write(fromAPI); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	// An export on its own again doesn't bring the duplicate back.
+	if err := w.Write(fromExport); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM bookmarks"); n != 1 {
+		t.Fatalf("expected 1 bookmark, got %d", n)
+	}
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM bookmarks WHERE id = '1234' AND selection = 'A selection'"); n != 1 {
+		t.Errorf("expected the bookmark to be stored under the API's ID with the export's selection")
+	}
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM full_texts WHERE bookmark_id = '1234'"); n != 1 {
+		t.Errorf("expected the export's full text to be kept, got %d", n)
+	}
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM full_text_search WHERE full_text_search MATCH ?", "gophers"); n != 1 {
+		t.Errorf("expected a single search result, got %d", n)
+	}
+}
+
+func TestSQLiteOutputWriter_WriteConcurrently(t *testing.T) {
+	defer cleanupTestTmpDir(sqliteOutputWriterTestDir)
+	w := &sqliteOutputWriter{Path: filepath.Join(sqliteOutputWriterTestDir, "instapaper.db")}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			err := w.Write(bookmarkData{
+				Bookmark:         &instapaper.Bookmark{ID: id, URL: "https://example.com/" + strconv.Itoa(id)},
+				FullText:         "<p>text</p>",
+				ContainingFolder: "unread",
+			})
+			if err != nil {
+				t.Errorf("write %d failed: %v", id, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := querySQLiteInt(t, w.db, "SELECT COUNT(*) FROM bookmarks"); n != 50 {
+		t.Fatalf("expected 50 bookmarks, got %d", n)
+	}
+}
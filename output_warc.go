@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWARCMaxSize is the size at which a new WARC file is started.
+const defaultWARCMaxSize = 1 << 30
+
+// warcIndexFileName is the CDX index of every WARC file in the archive.
+const warcIndexFileName = "index.cdx"
+
+// warcIndexHeader names the fields of each line of the CDX index: the SURT
+// of the URL, timestamp, original URL, MIME type, status, payload digest,
+// redirect, meta tags, compressed record length, offset and file name.
+const warcIndexHeader = " CDX N b a m s k r M S V g"
+
+// warcOpenSuffix marks WARC files which are still being written.
+const warcOpenSuffix = ".open"
+
+// warcOutputWriter writes WARC 1.1 files, with each record gzipped
+// separately so it can be read on its own, and a CDX index so standard web
+// archive tools can find them. Each bookmark gets a resource record for its
+// text, metadata records for its JSON and highlights, and a response
+// record for its original page if that was captured.
+//
+// WARC files are only ever added to: each run writes the bookmarks which
+// changed into new files, starting another once a file reaches MaxSize.
+type warcOutputWriter struct {
+	Directory string
+	// ArchiveDirectory is where captured original pages are read from. If
+	// empty, it's Directory.
+	ArchiveDirectory string
+	// MaxSize is the size in bytes at which to start a new WARC file. If
+	// zero, defaultWARCMaxSize is used.
+	MaxSize int64
+	// Force writes every bookmark, regardless of what the manifest says.
+	Force bool
+	// Manifest records what was last written for each bookmark so only
+	// those which changed are written again. If nil, every bookmark is
+	// written.
+	Manifest *syncManifest
+	// Progress is told how many records were written for each bookmark.
+	Progress *progressReporter
+
+	mu       sync.Mutex
+	run      string
+	sequence int
+	file     *os.File
+	fileName string
+	offset   int64
+	index    []string
+	// written are the bookmarks in the current file. They're only recorded
+	// in the manifest once it's closed and indexed.
+	written []bookmarkData
+}
+
+// warcRecord is a record to be written to a WARC file.
+type warcRecord struct {
+	ID           string
+	Type         string
+	TargetURI    string
+	Date         time.Time
+	ContentType  string
+	ConcurrentTo string
+	Block        []byte
+	// Payload is the part of Block which is indexed, if any. Only
+	// resource and response records are indexed.
+	Payload []byte
+	// MIMEType and Status are recorded in the index.
+	MIMEType string
+	Status   string
+}
+
+func (w *warcOutputWriter) Preflight() error {
+	if err := os.MkdirAll(w.Directory, 0755); err != nil {
+		return err
+	}
+	if err := removeAtomicWriteTempFiles(w.Directory); err != nil {
+		return err
+	}
+	// Files left open by an interrupted run aren't in the index, and their
+	// bookmarks weren't recorded in the manifest, so they'll be written
+	// again.
+	stale, err := filepath.Glob(filepath.Join(w.Directory, "*.warc.gz"+warcOpenSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	w.run = time.Now().UTC().Format("20060102150405")
+	return w.Manifest.Load()
+}
+
+func (w *warcOutputWriter) Write(bookmark bookmarkData) error {
+	files, err := w.writeFiles(bookmark)
+	if err != nil {
+		return err
+	}
+	w.Progress.BookmarkWritten(files)
+	return nil
+}
+
+// writeFiles writes the bookmark, returning how many records it wrote.
+func (w *warcOutputWriter) writeFiles(bookmark bookmarkData) (int, error) {
+	changes := w.Manifest.Changes(bookmark)
+	if w.Force || w.Manifest == nil {
+		changes = allSyncManifestChanges
+	}
+	records, err := w.bookmarkRecords(bookmark, changes)
+	if err != nil {
+		slog.Error("error building WARC records", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+		return 0, err
+	}
+	if len(records) > 0 {
+		w.mu.Lock()
+		err = w.writeRecords(records)
+		if err == nil {
+			w.written = append(w.written, bookmark)
+		}
+		w.mu.Unlock()
+		if err != nil {
+			slog.Error("error writing WARC records", bookmark.logArgs("stage", logStageWrite, "error", err)...)
+			return 0, err
+		}
+	} else {
+		w.Manifest.Update(bookmark)
+	}
+	return len(records), nil
+}
+
+// bookmarkRecords returns the records for whatever changed about the
+// bookmark.
+func (w *warcOutputWriter) bookmarkRecords(bookmark bookmarkData, changes syncManifestChanges) ([]warcRecord, error) {
+	if !changes.Metadata && !changes.FullText && !changes.Highlights {
+		return nil, nil
+	}
+	now := time.Now().UTC()
+	targetURI := bookmark.GetURL()
+	var records []warcRecord
+	newRecord := func(record warcRecord) error {
+		id, err := newWARCRecordID()
+		if err != nil {
+			return err
+		}
+		record.ID = id
+		records = append(records, record)
+		return nil
+	}
+
+	if changes.FullText && len(bookmark.FullText) > 0 {
+		if bookmark.TextSource == textSourceOriginal {
+			page, ok, err := w.capturedPageRecord(bookmark)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				records = append(records, page)
+			}
+		}
+		err := newRecord(warcRecord{
+			Type:        "resource",
+			TargetURI:   targetURI,
+			Date:        now,
+			ContentType: "text/html; charset=utf-8",
+			Block:       []byte(bookmark.FullText),
+			Payload:     []byte(bookmark.FullText),
+			MIMEType:    "text/html",
+			Status:      "-",
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Metadata records describe the text, if it was written alongside them.
+	concurrentTo := ""
+	if n := len(records); n > 0 {
+		concurrentTo = records[n-1].ID
+	}
+
+	metadata, err := json.MarshalIndent(bookmark, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = newRecord(warcRecord{
+		Type:         "metadata",
+		TargetURI:    targetURI,
+		Date:         now,
+		ContentType:  "application/json",
+		ConcurrentTo: concurrentTo,
+		Block:        metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(bookmark.Highlights) > 0 {
+		highlights, err := json.MarshalIndent(bookmark.Highlights, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		err = newRecord(warcRecord{
+			Type:         "metadata",
+			TargetURI:    targetURI,
+			Date:         now,
+			ContentType:  "application/json",
+			ConcurrentTo: concurrentTo,
+			Block:        highlights,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// capturedPageRecord returns a response record for the bookmark's original
+// page, rebuilt from what -capture-pages kept, if there is one.
+func (w *warcOutputWriter) capturedPageRecord(bookmark bookmarkData) (warcRecord, bool, error) {
+	archiveDirectory := w.ArchiveDirectory
+	if archiveDirectory == "" {
+		archiveDirectory = w.Directory
+	}
+	pagePath := filepath.Join(archiveDirectory, pageCaptureDirName, bookmark.GetID())
+	if !fileExists(pagePath+".html") || !fileExists(pagePath+".json") {
+		return warcRecord{}, false, nil
+	}
+	body, err := ioutil.ReadFile(pagePath + ".html")
+	if err != nil {
+		return warcRecord{}, false, err
+	}
+	data, err := ioutil.ReadFile(pagePath + ".json")
+	if err != nil {
+		return warcRecord{}, false, err
+	}
+	var page capturedPage
+	if err := json.Unmarshal(data, &page); err != nil {
+		return warcRecord{}, false, fmt.Errorf("error reading %s.json: %v", pagePath, err)
+	}
+
+	var block bytes.Buffer
+	fmt.Fprintf(&block, "HTTP/1.1 %d %s\r\n", page.StatusCode, http.StatusText(page.StatusCode))
+	header := page.Header.Clone()
+	// The body was kept as it was decoded, so describe it as such.
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if err := header.Write(&block); err != nil {
+		return warcRecord{}, false, err
+	}
+	block.WriteString("\r\n")
+	block.Write(body)
+
+	id, err := newWARCRecordID()
+	if err != nil {
+		return warcRecord{}, false, err
+	}
+	mediaType, _, _ := mime.ParseMediaType(page.Header.Get("Content-Type"))
+	return warcRecord{
+		ID:          id,
+		Type:        "response",
+		TargetURI:   page.URL,
+		Date:        page.FetchedAt.UTC(),
+		ContentType: "application/http; msgtype=response",
+		Block:       block.Bytes(),
+		Payload:     body,
+		MIMEType:    mediaType,
+		Status:      strconv.Itoa(page.StatusCode),
+	}, true, nil
+}
+
+// writeRecords appends the records to the current WARC file, starting a new
+// one first if it's full, so a bookmark's records are kept together.
+func (w *warcOutputWriter) writeRecords(records []warcRecord) error {
+	if w.file == nil || w.offset >= w.maxSize() {
+		if err := w.finishFile(); err != nil {
+			return err
+		}
+		if err := w.openFile(); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		offset := w.offset
+		if err := w.writeRecord(record); err != nil {
+			return err
+		}
+		if record.Payload != nil {
+			w.index = append(w.index, warcIndexLine(record, w.offset-offset, offset, w.fileName))
+		}
+	}
+	return nil
+}
+
+func (w *warcOutputWriter) maxSize() int64 {
+	if w.MaxSize > 0 {
+		return w.MaxSize
+	}
+	return defaultWARCMaxSize
+}
+
+// openFile starts the next WARC file for this run with a warcinfo record.
+func (w *warcOutputWriter) openFile() error {
+	for {
+		w.sequence++
+		w.fileName = fmt.Sprintf("instapaper-%s-%05d.warc.gz", w.run, w.sequence)
+		path := filepath.Join(w.Directory, w.fileName)
+		if !fileExists(path) && !fileExists(path+warcOpenSuffix) {
+			break
+		}
+	}
+	file, err := os.OpenFile(filepath.Join(w.Directory, w.fileName+warcOpenSuffix), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w.file, w.offset = file, 0
+	id, err := newWARCRecordID()
+	if err != nil {
+		return err
+	}
+	return w.writeRecord(warcRecord{
+		ID:          id,
+		Type:        "warcinfo",
+		Date:        time.Now().UTC(),
+		ContentType: "application/warc-fields",
+		Block: []byte("software: instapaper-archive\r\n" +
+			"format: WARC File Format 1.1\r\n" +
+			"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n"),
+	})
+}
+
+// finishFile closes the current WARC file, if any, adds its records to the
+// index, and only then records its bookmarks in the manifest, so they're
+// written again if any of that fails.
+func (w *warcOutputWriter) finishFile() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if len(w.index) > 0 {
+		if err := w.writeIndex(); err != nil {
+			return err
+		}
+		w.index = nil
+	}
+	for _, bookmark := range w.written {
+		w.Manifest.Update(bookmark)
+	}
+	w.written = nil
+	return nil
+}
+
+// closeFile closes the current WARC file, if any, giving it its final
+// name.
+func (w *warcOutputWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	file := w.file
+	w.file = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(w.Directory, w.fileName)
+	return os.Rename(path+warcOpenSuffix, path)
+}
+
+// writeRecord writes the record to the current file as its own gzip member.
+func (w *warcOutputWriter) writeRecord(record warcRecord) error {
+	var header bytes.Buffer
+	header.WriteString("WARC/1.1\r\n")
+	fmt.Fprintf(&header, "WARC-Type: %s\r\n", record.Type)
+	fmt.Fprintf(&header, "WARC-Record-ID: %s\r\n", record.ID)
+	fmt.Fprintf(&header, "WARC-Date: %s\r\n", record.Date.Format("2006-01-02T15:04:05Z"))
+	if record.Type == "warcinfo" {
+		fmt.Fprintf(&header, "WARC-Filename: %s\r\n", w.fileName)
+	}
+	if record.TargetURI != "" {
+		fmt.Fprintf(&header, "WARC-Target-URI: %s\r\n", record.TargetURI)
+	}
+	if record.ConcurrentTo != "" {
+		fmt.Fprintf(&header, "WARC-Concurrent-To: %s\r\n", record.ConcurrentTo)
+	}
+	fmt.Fprintf(&header, "Content-Type: %s\r\n", record.ContentType)
+	fmt.Fprintf(&header, "WARC-Block-Digest: %s\r\n", warcDigest(record.Block))
+	if record.Payload != nil {
+		fmt.Fprintf(&header, "WARC-Payload-Digest: %s\r\n", warcDigest(record.Payload))
+	}
+	fmt.Fprintf(&header, "Content-Length: %d\r\n\r\n", len(record.Block))
+
+	counter := &countingWriter{w: w.file}
+	gz := gzip.NewWriter(counter)
+	for _, part := range [][]byte{header.Bytes(), record.Block, []byte("\r\n\r\n")} {
+		if _, err := gz.Write(part); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	w.offset += counter.n
+	return nil
+}
+
+// Close finishes the last WARC file and adds this run's records to the
+// index.
+func (w *warcOutputWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.finishFile(); err != nil {
+		return err
+	}
+	return w.Manifest.Save()
+}
+
+// writeIndex merges this run's lines into the index, which is kept sorted
+// as CDX readers expect.
+func (w *warcOutputWriter) writeIndex() error {
+	indexPath := filepath.Join(w.Directory, warcIndexFileName)
+	lines := map[string]bool{}
+	for _, line := range w.index {
+		lines[line] = true
+	}
+	if f, err := os.Open(indexPath); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" && line != warcIndexHeader {
+				lines[line] = true
+			}
+		}
+		err := scanner.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", indexPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	sorted := make([]string, 0, len(lines))
+	for line := range lines {
+		sorted = append(sorted, line)
+	}
+	sort.Strings(sorted)
+	return writeFileAtomicFunc(indexPath, 0644, func(out io.Writer) error {
+		if _, err := fmt.Fprintln(out, warcIndexHeader); err != nil {
+			return err
+		}
+		for _, line := range sorted {
+			if _, err := fmt.Fprintln(out, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// warcIndexLine returns the CDX line for a record of the given compressed
+// length at offset in fileName.
+func warcIndexLine(record warcRecord, length, offset int64, fileName string) string {
+	mimeType := record.MIMEType
+	if mimeType == "" {
+		mimeType = "-"
+	}
+	originalURL := strings.ReplaceAll(record.TargetURI, " ", "%20")
+	return fmt.Sprintf("%s %s %s %s %s %s - - %d %d %s",
+		surtKey(originalURL),
+		record.Date.Format("20060102150405"),
+		originalURL,
+		mimeType,
+		record.Status,
+		strings.TrimPrefix(warcDigest(record.Payload), "sha1:"),
+		length,
+		offset,
+		fileName,
+	)
+}
+
+// surtKey canonicalizes a URL as a Sort-friendly URI Reordering Transform,
+// e.g. com,example)/path?a=1&b=2, so captures of the same page sort
+// together.
+func surtKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(rawURL)
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	key := strings.Join(labels, ",")
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		key += ":" + port
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key += ")" + strings.ToLower(path)
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		sort.Strings(params)
+		key += "?" + strings.ToLower(strings.Join(params, "&"))
+	}
+	return key
+}
+
+// warcDigest is the SHA-1 digest of data, as WARC headers and CDX indexes
+// record it.
+func warcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// newWARCRecordID returns a random (version 4) UUID URN.
+func newWARCRecordID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("error generating WARC record ID: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var warcOutputWriterTestDir = filepath.Join("tmp", "warcOutputWriter")
+
+// testWARCRecord is a record read back from a WARC file.
+type testWARCRecord struct {
+	Header map[string]string
+	Block  []byte
+}
+
+// readWARCRecord reads one gzipped record, checking it's well formed.
+func readWARCRecord(t *testing.T, r io.Reader) testWARCRecord {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("unable to read gzip member: %v", err)
+	}
+	gz.Multistream(false)
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("unable to read gzip member: %v", err)
+	}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	version, _ := reader.ReadString('\n')
+	if version != "WARC/1.1\r\n" {
+		t.Fatalf("expected a WARC/1.1 record, got %q", version)
+	}
+	record := testWARCRecord{Header: map[string]string{}}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected end of headers: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		key, value, ok := strings.Cut(strings.TrimSuffix(line, "\r\n"), ": ")
+		if !ok {
+			t.Fatalf("malformed header %q", line)
+		}
+		record.Header[key] = value
+	}
+	length, err := strconv.Atoi(record.Header["Content-Length"])
+	if err != nil {
+		t.Fatalf("bad Content-Length: %v", err)
+	}
+	record.Block = make([]byte, length)
+	if _, err := io.ReadFull(reader, record.Block); err != nil {
+		t.Fatalf("unable to read block: %v", err)
+	}
+	if rest, _ := ioutil.ReadAll(reader); string(rest) != "\r\n\r\n" {
+		t.Fatalf("expected the record to end with two CRLFs, got %q", rest)
+	}
+	if digest := record.Header["WARC-Block-Digest"]; digest != warcDigest(record.Block) {
+		t.Fatalf("expected block digest %s, got %s", warcDigest(record.Block), digest)
+	}
+	return record
+}
+
+// readWARCFile reads every record in a WARC file.
+func readWARCFile(t *testing.T, path string) []testWARCRecord {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read %s: %v", path, err)
+	}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	var records []testWARCRecord
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			return records
+		}
+		records = append(records, readWARCRecord(t, reader))
+	}
+}
+
+func warcFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.warc.gz"))
+	if err != nil {
+		t.Fatalf("unable to list WARC files: %v", err)
+	}
+	return files
+}
+
+func readWARCIndex(t *testing.T, dir string) [][]string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, warcIndexFileName))
+	if err != nil {
+		t.Fatalf("unable to read index: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if lines[0] != warcIndexHeader {
+		t.Fatalf("expected the index to start with %q, got %q", warcIndexHeader, lines[0])
+	}
+	var fields [][]string
+	for _, line := range lines[1:] {
+		fields = append(fields, strings.Fields(line))
+	}
+	return fields
+}
+
+func TestWARCOutputWriter_Write(t *testing.T) {
+	w := &warcOutputWriter{Directory: warcOutputWriterTestDir}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(warcOutputWriterTestDir)
+
+	withHighlights := newTestBookmark(1234, "<p>full text</p>")
+	withHighlights.Bookmark.URL = "https://www.example.com/bookmark1234?b=2&a=1"
+	withHighlights.Highlights = []instapaper.Highlight{{ID: 1, BookmarkID: 1234, Text: "full text"}}
+
+	// A bookmark whose text came from its captured original page.
+	captured := newTestBookmark(5678, "<p>extracted</p>")
+	captured.TextSource = textSourceOriginal
+	page := capturedPage{
+		URL:        "https://example.com/final",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Content-Length": {"1"}},
+		FetchedAt:  time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC),
+	}
+	pageDir := filepath.Join(warcOutputWriterTestDir, pageCaptureDirName)
+	if err := os.MkdirAll(pageDir, 0755); err != nil {
+		t.Fatalf("unable to create %s: %v", pageDir, err)
+	}
+	pageJSON, _ := json.Marshal(page)
+	if err := ioutil.WriteFile(filepath.Join(pageDir, "5678.json"), pageJSON, 0644); err != nil {
+		t.Fatalf("unable to write page: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pageDir, "5678.html"), []byte("<html><p>extracted</p></html>"), 0644); err != nil {
+		t.Fatalf("unable to write page: %v", err)
+	}
+
+	for _, bookmark := range []bookmarkData{withHighlights, captured} {
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	files := warcFiles(t, warcOutputWriterTestDir)
+	if len(files) != 1 {
+		t.Fatalf("expected one WARC file, got %v", files)
+	}
+	records := readWARCFile(t, files[0])
+	var types []string
+	for _, record := range records {
+		types = append(types, record.Header["WARC-Type"])
+		if !strings.HasPrefix(record.Header["WARC-Record-ID"], "<urn:uuid:") {
+			t.Errorf("expected a UUID record ID, got %q", record.Header["WARC-Record-ID"])
+		}
+	}
+	if expected := "warcinfo resource metadata metadata response resource metadata"; strings.Join(types, " ") != expected {
+		t.Fatalf("expected records %q, got %q", expected, strings.Join(types, " "))
+	}
+	if name := records[0].Header["WARC-Filename"]; name != filepath.Base(files[0]) {
+		t.Errorf("expected warcinfo to name %s, got %q", filepath.Base(files[0]), name)
+	}
+
+	text := records[1]
+	if text.Header["WARC-Target-URI"] != withHighlights.GetURL() || string(text.Block) != "<p>full text</p>" {
+		t.Errorf("unexpected resource record: %v\n%s", text.Header, text.Block)
+	}
+	if text.Header["Content-Type"] != "text/html; charset=utf-8" {
+		t.Errorf("unexpected resource content type %q", text.Header["Content-Type"])
+	}
+	metadata := records[2]
+	if metadata.Header["Content-Type"] != "application/json" || !strings.Contains(string(metadata.Block), `"ContainingFolder": "Unread"`) {
+		t.Errorf("unexpected metadata record: %v\n%s", metadata.Header, metadata.Block)
+	}
+	if metadata.Header["WARC-Concurrent-To"] != text.Header["WARC-Record-ID"] {
+		t.Errorf("expected metadata to be concurrent to %s, got %q", text.Header["WARC-Record-ID"], metadata.Header["WARC-Concurrent-To"])
+	}
+	if !strings.Contains(string(records[3].Block), `"Text": "full text"`) {
+		t.Errorf("expected highlights metadata, got:\n%s", records[3].Block)
+	}
+
+	response := records[4]
+	if response.Header["WARC-Target-URI"] != "https://example.com/final" || response.Header["WARC-Date"] != "2021-02-03T04:05:06Z" {
+		t.Errorf("unexpected response record: %v", response.Header)
+	}
+	if response.Header["Content-Type"] != "application/http; msgtype=response" {
+		t.Errorf("unexpected response content type %q", response.Header["Content-Type"])
+	}
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response.Block)), nil)
+	if err != nil {
+		t.Fatalf("unable to read response: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "<html><p>extracted</p></html>" {
+		t.Errorf("unexpected response %d: %q", res.StatusCode, body)
+	}
+	if digest := response.Header["WARC-Payload-Digest"]; digest != warcDigest(body) {
+		t.Errorf("expected payload digest %s, got %s", warcDigest(body), digest)
+	}
+
+	// Every resource and response is indexed, in order, and can be read from
+	// its offset.
+	index := readWARCIndex(t, warcOutputWriterTestDir)
+	if len(index) != 3 {
+		t.Fatalf("expected 3 index lines, got %v", index)
+	}
+	for i, fields := range index {
+		if len(fields) != 11 {
+			t.Fatalf("expected 11 fields, got %v", fields)
+		}
+		if i > 0 && strings.Join(index[i-1], " ") > strings.Join(fields, " ") {
+			t.Errorf("expected the index to be sorted, got %v", index)
+		}
+		offset, _ := strconv.ParseInt(fields[9], 10, 64)
+		length, _ := strconv.ParseInt(fields[8], 10, 64)
+		f, err := os.Open(filepath.Join(warcOutputWriterTestDir, fields[10]))
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", fields[10], err)
+		}
+		record := readWARCRecord(t, io.NewSectionReader(f, offset, length))
+		f.Close()
+		if record.Header["WARC-Target-URI"] != fields[2] {
+			t.Errorf("expected record at %d to be for %s, got %v", offset, fields[2], record.Header)
+		}
+		if "sha1:"+fields[5] != record.Header["WARC-Payload-Digest"] {
+			t.Errorf("expected digest %s, got %s", fields[5], record.Header["WARC-Payload-Digest"])
+		}
+	}
+	if index[0][0] != "com,example)/bookmark1234?a=1&b=2" || index[0][3] != "text/html" || index[0][4] != "-" {
+		t.Errorf("unexpected index line for the text: %v", index[0])
+	}
+	if index[2][0] != "com,example)/final" || index[2][1] != "20210203040506" || index[2][4] != "200" {
+		t.Errorf("unexpected index line for the response: %v", index[2])
+	}
+}
+
+func TestWARCOutputWriter_RollsOver(t *testing.T) {
+	w := &warcOutputWriter{Directory: warcOutputWriterTestDir, MaxSize: 1}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(warcOutputWriterTestDir)
+	for id := 1; id <= 3; id++ {
+		if err := w.Write(newTestBookmark(id, "<p>text</p>")); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	files := warcFiles(t, warcOutputWriterTestDir)
+	if len(files) != 3 {
+		t.Fatalf("expected a WARC file per bookmark, got %v", files)
+	}
+	for _, file := range files {
+		records := readWARCFile(t, file)
+		if len(records) != 3 || records[0].Header["WARC-Type"] != "warcinfo" {
+			t.Errorf("expected %s to have a warcinfo record and one bookmark's records, got %d records", file, len(records))
+		}
+	}
+	if index := readWARCIndex(t, warcOutputWriterTestDir); len(index) != 3 {
+		t.Fatalf("expected 3 index lines, got %v", index)
+	}
+}
+
+func TestWARCOutputWriter_WriteWithManifest(t *testing.T) {
+	newWriter := func() *warcOutputWriter {
+		return &warcOutputWriter{
+			Directory: warcOutputWriterTestDir,
+			Manifest:  newSyncManifest(filepath.Join(warcOutputWriterTestDir, syncManifestFileName)),
+		}
+	}
+	defer cleanupTestTmpDir(warcOutputWriterTestDir)
+	run := func(bookmarks ...bookmarkData) {
+		w := newWriter()
+		if err := w.Preflight(); err != nil {
+			t.Fatalf("preflight failed: %v", err)
+		}
+		for _, bookmark := range bookmarks {
+			if err := w.Write(bookmark); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+	}
+
+	bookmark := newTestBookmark(1234, "<p>full text</p>")
+	run(bookmark)
+
+	// Unchanged bookmarks aren't written again.
+	run(bookmark)
+	if files := warcFiles(t, warcOutputWriterTestDir); len(files) != 1 {
+		t.Fatalf("expected no new WARC files, got %v", files)
+	}
+
+	// A file left open by an interrupted run is removed.
+	openPath := filepath.Join(warcOutputWriterTestDir, "instapaper-20200101000000-00001.warc.gz"+warcOpenSuffix)
+	if err := ioutil.WriteFile(openPath, []byte("partial"), 0644); err != nil {
+		t.Fatalf("unable to write %s: %v", openPath, err)
+	}
+
+	// Changed metadata is written without the text, which hasn't changed,
+	// and the index keeps the earlier capture.
+	bookmark.ContainingFolder = "Archive"
+	run(bookmark)
+	if fileExists(openPath) {
+		t.Errorf("expected %s to be removed", openPath)
+	}
+	files := warcFiles(t, warcOutputWriterTestDir)
+	if len(files) != 2 {
+		t.Fatalf("expected a new WARC file, got %v", files)
+	}
+	records := readWARCFile(t, files[1])
+	if len(records) != 2 || records[1].Header["WARC-Type"] != "metadata" || records[1].Header["WARC-Concurrent-To"] != "" {
+		t.Fatalf("expected just a metadata record, got %d records", len(records))
+	}
+	if index := readWARCIndex(t, warcOutputWriterTestDir); len(index) != 1 || index[0][10] != filepath.Base(files[0]) {
+		t.Fatalf("expected the index to keep the first capture, got %v", index)
+	}
+}
+
+func TestWARCOutputWriter_ManifestWaitsForIndex(t *testing.T) {
+	w := &warcOutputWriter{
+		Directory: warcOutputWriterTestDir,
+		MaxSize:   1,
+		Manifest:  newSyncManifest(filepath.Join(warcOutputWriterTestDir, syncManifestFileName)),
+	}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(warcOutputWriterTestDir)
+	written := func(bookmark bookmarkData) bool {
+		return w.Manifest.Changes(bookmark) == syncManifestChanges{}
+	}
+
+	first, second := newTestBookmark(1, "<p>text</p>"), newTestBookmark(2, "<p>text</p>")
+	if err := w.Write(first); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if written(first) {
+		t.Errorf("expected the bookmark to wait for its file to be closed")
+	}
+	// The second bookmark starts a new file, closing the first.
+	if err := w.Write(second); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if !written(first) || written(second) {
+		t.Errorf("expected only the bookmark in the closed file to be recorded")
+	}
+
+	// A bookmark whose file can't be indexed is written again next time.
+	indexPath := filepath.Join(warcOutputWriterTestDir, warcIndexFileName)
+	if err := os.Remove(indexPath); err != nil {
+		t.Fatalf("unable to remove %s: %v", indexPath, err)
+	}
+	if err := os.Mkdir(indexPath, 0755); err != nil {
+		t.Fatalf("unable to create %s: %v", indexPath, err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatalf("expected close to fail without an index")
+	}
+	if written(second) {
+		t.Errorf("expected the bookmark not to be recorded when its file wasn't indexed")
+	}
+}
+
+func TestSURTKey(t *testing.T) {
+	for input, expected := range map[string]string{
+		"https://www.Example.com/Path?b=2&a=1": "com,example)/path?a=1&b=2",
+		"http://example.com":                   "com,example)/",
+		"http://example.com:8080/x":            "com,example:8080)/x",
+		"https://sub.example.co.uk:443/":       "uk,co,example,sub)/",
+	} {
+		if actual := surtKey(input); actual != expected {
+			t.Errorf("surtKey(%q): expected %q, got %q", input, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// progressReporter tracks how far along a run is. The job queue reports on
+// jobs, jobs report on what they fetched, and output writers report on what
+// they wrote. A nil reporter ignores everything.
+type progressReporter struct {
+	start time.Time
+
+	discovered   int64
+	csvBookmarks int64
+	apiBookmarks int64
+
+	submitted int64
+	inFlight  int64
+	succeeded int64
+	failed    int64
+	unchanged int64
+
+	fullTexts    int64
+	highlights   int64
+	filesWritten int64
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newProgressReporter() *progressReporter {
+	return &progressReporter{start: time.Now(), stop: make(chan struct{})}
+}
+
+// Discovered records how many bookmarks there are to archive, and where
+// they were found. Bookmarks can be found in both places.
+func (p *progressReporter) Discovered(total, fromCSV, fromAPI int) {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.discovered, int64(total))
+	atomic.StoreInt64(&p.csvBookmarks, int64(fromCSV))
+	atomic.StoreInt64(&p.apiBookmarks, int64(fromAPI))
+}
+
+func (p *progressReporter) JobSubmitted() {
+	if p != nil {
+		atomic.AddInt64(&p.submitted, 1)
+	}
+}
+
+func (p *progressReporter) JobStarted() {
+	if p != nil {
+		atomic.AddInt64(&p.inFlight, 1)
+	}
+}
+
+func (p *progressReporter) JobFinished(err error) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.inFlight, -1)
+	if err != nil {
+		atomic.AddInt64(&p.failed, 1)
+	} else {
+		atomic.AddInt64(&p.succeeded, 1)
+	}
+}
+
+func (p *progressReporter) FullTextFetched() {
+	if p != nil {
+		atomic.AddInt64(&p.fullTexts, 1)
+	}
+}
+
+func (p *progressReporter) HighlightsFetched(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.highlights, int64(n))
+	}
+}
+
+// BookmarkWritten records how many files an output writer wrote for a
+// bookmark. None means it was already archived and unchanged.
+func (p *progressReporter) BookmarkWritten(files int) {
+	if p == nil {
+		return
+	}
+	if files == 0 {
+		atomic.AddInt64(&p.unchanged, 1)
+	}
+	atomic.AddInt64(&p.filesWritten, int64(files))
+}
+
+// FilesWritten returns how many files output writers have written.
+func (p *progressReporter) FilesWritten() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.filesWritten)
+}
+
+// Status returns a one-line summary of the run so far.
+func (p *progressReporter) Status() string {
+	finished := atomic.LoadInt64(&p.succeeded) + atomic.LoadInt64(&p.failed)
+	total := atomic.LoadInt64(&p.discovered)
+	if total == 0 {
+		total = atomic.LoadInt64(&p.submitted)
+	}
+	status := fmt.Sprintf("%d/%d bookmarks", finished, total)
+	if total > 0 {
+		status += fmt.Sprintf(" (%d%%)", finished*100/total)
+	}
+	status += fmt.Sprintf(", %d in flight, %d failed, %d unchanged",
+		atomic.LoadInt64(&p.inFlight), atomic.LoadInt64(&p.failed), atomic.LoadInt64(&p.unchanged))
+	if eta, ok := p.eta(finished, total); ok {
+		status += ", ETA " + eta.String()
+	}
+	return status
+}
+
+func (p *progressReporter) eta(finished, total int64) (time.Duration, bool) {
+	if finished == 0 || total == 0 || atomic.LoadInt64(&p.discovered) == 0 {
+		return 0, false
+	}
+	elapsed := time.Since(p.start)
+	remaining := time.Duration(float64(elapsed) / float64(finished) * float64(total-finished))
+	return remaining.Round(time.Second), true
+}
+
+// Start reports progress to w until Stop is called: as a status line which
+// is redrawn in place if w is a terminal, or as a line every interval if not.
+func (p *progressReporter) Start(w io.Writer, interval time.Duration) {
+	tty := isTerminal(w)
+	if tty {
+		interval = 250 * time.Millisecond
+	}
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if tty {
+					fmt.Fprintf(w, "\r\033[K%s", p.Status())
+				} else {
+					fmt.Fprintf(w, "progress: %s\n", p.Status())
+				}
+			case <-p.stop:
+				if tty {
+					fmt.Fprint(w, "\r\033[K")
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (p *progressReporter) Stop() {
+	close(p.stop)
+	p.stopped.Wait()
+}
+
+// PrintSummary writes a table of what the run did to w.
+func (p *progressReporter) PrintSummary(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	rows := []struct {
+		label string
+		value interface{}
+	}{
+		{"Bookmarks discovered", atomic.LoadInt64(&p.discovered)},
+		{"  from CSV export", atomic.LoadInt64(&p.csvBookmarks)},
+		{"  from API", atomic.LoadInt64(&p.apiBookmarks)},
+		{"Bookmarks archived", atomic.LoadInt64(&p.succeeded)},
+		{"Bookmarks unchanged", atomic.LoadInt64(&p.unchanged)},
+		{"Bookmarks failed", atomic.LoadInt64(&p.failed)},
+		{"Full texts fetched", atomic.LoadInt64(&p.fullTexts)},
+		{"Highlights fetched", atomic.LoadInt64(&p.highlights)},
+		{"Files written", atomic.LoadInt64(&p.filesWritten)},
+		{"Elapsed", time.Since(p.start).Round(time.Millisecond)},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%v\n", row.label, row.value)
+	}
+	tw.Flush()
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProgressReporter(t *testing.T) {
+	progress := newProgressReporter()
+	progress.Discovered(4, 3, 2)
+
+	queue := NewJobQueue(2)
+	queue.ReportProgress(progress)
+	queue.Start(context.Background())
+	defer queue.Stop()
+	for i, err := range []error{nil, nil, errors.New("oops")} {
+		if err := queue.Submit(context.Background(), testJob{id: string(rune('a' + i)), err: err}); err != nil {
+			t.Fatalf("submit failed: %v", err)
+		}
+	}
+	queue.Wait()
+
+	status := progress.Status()
+	if !strings.HasPrefix(status, "3/4 bookmarks (75%), 0 in flight, 1 failed, 0 unchanged, ETA ") {
+		t.Fatalf("unexpected status: %q", status)
+	}
+}
+
+func TestProgressReporter_Writers(t *testing.T) {
+	defer cleanupTestTmpDir(jekyllOutputWriterTestDir)
+	progress := newProgressReporter()
+	w := jekyllOutputWriter{
+		Directory: jekyllOutputWriterTestDir,
+		Manifest:  newSyncManifest(jekyllOutputWriterTestDir + "/" + syncManifestFileName),
+		Progress:  progress,
+	}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	bookmark := bookmarkData{
+		Bookmark:   &instapaper.Bookmark{ID: 1234, URL: "https://example.com/bookmark1234"},
+		FullText:   "full text",
+		Highlights: []instapaper.Highlight{{ID: 1, Text: "highlight"}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	var summary bytes.Buffer
+	progress.PrintSummary(&summary)
+	for _, row := range []string{"Files written         4\n", "Bookmarks unchanged   1\n"} {
+		if !strings.Contains(summary.String(), row) {
+			t.Errorf("expected summary to contain %q:\n%s", row, summary.String())
+		}
+	}
+}
+
+func TestProgressReporter_Start(t *testing.T) {
+	progress := newProgressReporter()
+	progress.Discovered(10, 10, 0)
+	var out lockedBuffer
+	progress.Start(&out, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	progress.Stop()
+
+	if !strings.HasPrefix(out.String(), "progress: 0/10 bookmarks (0%), 0 in flight, 0 failed, 0 unchanged\n") {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// apiRateLimiter throttles every call made to the Instapaper API with a
+// token bucket shared by all workers, and retries calls which fail with
+// transient errors. When the API reports that we're over its rate limit,
+// every caller backs off until the pause is over.
+type apiRateLimiter struct {
+	limiter *rate.Limiter
+	// InitialBackoff is roughly how long to wait after the first transient
+	// error. It doubles for each consecutive one, up to MaxBackoff, and is
+	// jittered so workers don't retry in lockstep.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxAttempts is how many times a call is made before giving up on a
+	// transient error.
+	MaxAttempts int
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func newAPIRateLimiter(requestsPerSecond float64, burst int) *apiRateLimiter {
+	return &apiRateLimiter{
+		limiter:        rate.NewLimiter(rate.Limit(requestsPerSecond), burst),
+		InitialBackoff: 2 * time.Second,
+		MaxBackoff:     2 * time.Minute,
+		MaxAttempts:    5,
+	}
+}
+
+// Do calls fn once the rate limit allows it, retrying with exponential
+// backoff while it returns transient errors. A nil limiter calls fn once,
+// straight away. It gives up waiting as soon as ctx is done.
+func (l *apiRateLimiter) Do(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if l == nil {
+		return fn()
+	}
+	backoff := l.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if err := l.wait(ctx); err != nil {
+			return err
+		}
+		err := fn()
+		if !isTransientAPIError(err) || attempt >= l.MaxAttempts {
+			return err
+		}
+		delay := jitter(backoff)
+		slog.Warn("transient API error, retrying", "delay", delay, "attempt", attempt, "max_attempts", l.MaxAttempts, "error", err)
+		if isRateLimitError(err) {
+			l.pause(delay)
+		} else if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+		backoff *= 2
+		if backoff > l.MaxBackoff {
+			backoff = l.MaxBackoff
+		}
+	}
+}
+
+func (l *apiRateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	pause := time.Until(l.pausedUntil)
+	l.mu.Unlock()
+	if err := sleepContext(ctx, pause); err != nil {
+		return err
+	}
+	return l.limiter.Wait(ctx)
+}
+
+// pause stops every caller from making requests for d.
+func (l *apiRateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// sleepContext sleeps for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
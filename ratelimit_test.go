@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+func newTestAPIRateLimiter() *apiRateLimiter {
+	l := newAPIRateLimiter(1000, 1)
+	l.InitialBackoff = time.Millisecond
+	l.MaxBackoff = 2 * time.Millisecond
+	l.MaxAttempts = 3
+	return l
+}
+
+func TestAPIRateLimiter_RetriesRateLimitErrors(t *testing.T) {
+	l := newTestAPIRateLimiter()
+	calls := 0
+	err := l.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return &instapaper.APIError{ErrorCode: instapaper.ErrRateLimitExceeded, StatusCode: 400}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestAPIRateLimiter_GivesUp(t *testing.T) {
+	l := newTestAPIRateLimiter()
+	calls := 0
+	err := l.Do(context.Background(), func() error {
+		calls++
+		return &instapaper.APIError{StatusCode: 429}
+	})
+	if !isRateLimitError(err) {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	if calls != l.MaxAttempts {
+		t.Fatalf("expected %d calls, got %d", l.MaxAttempts, calls)
+	}
+}
+
+func TestAPIRateLimiter_DoesNotRetryOtherErrors(t *testing.T) {
+	l := newTestAPIRateLimiter()
+	calls := 0
+	failure := errors.New("oops")
+	err := l.Do(context.Background(), func() error {
+		calls++
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("expected %v, got %v", failure, err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestAPIRateLimiter_Throttles(t *testing.T) {
+	l := newAPIRateLimiter(100, 1)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_ = l.Do(context.Background(), func() error { return nil })
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected 6 calls at 100/s to take at least 50ms, took %s", elapsed)
+	}
+}
+
+func TestAPIRateLimiter_Cancellation(t *testing.T) {
+	l := newTestAPIRateLimiter()
+	l.InitialBackoff = time.Hour
+	l.MaxBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := l.Do(ctx, func() error {
+		calls++
+		cancel()
+		return &instapaper.APIError{StatusCode: 503}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected backoff to be cancelled, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// renderArchive regenerates an archive as described by options from the bookmark store in
+// archiveDirectory, without the API.
+func renderArchive(archiveDirectory, outputDirectory string, options outputOptions, out io.Writer) error {
+	store := newBookmarkStore(archiveDirectory)
+	if !fileExists(store.Directory) {
+		return fmt.Errorf("no bookmarks stored in %s: archive them without -offline first", archiveDirectory)
+	}
+	outputWriter, err := newOutputWriter(archiveDirectory, outputDirectory, options, nil)
+	if err != nil {
+		return err
+	}
+	if err := outputWriter.Preflight(); err != nil {
+		return err
+	}
+	rendered := 0
+	err = store.Each(func(bookmark bookmarkData) error {
+		if err := outputWriter.Write(bookmark); err != nil {
+			return fmt.Errorf("error writing %s: %v", bookmark.GetID(), err)
+		}
+		rendered++
+		return nil
+	})
+	if closeErr := outputWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "rendered %d bookmark(s) into %s\n", rendered, outputDirectory)
+	return nil
+}
+
+func runRender(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	var directory string
+	flags.StringVar(&directory, "directory", "archive", "The directory containing the archive")
+	var outputDirectory string
+	flags.StringVar(&outputDirectory, "output", "", "The directory in which to write the rendered archive (defaults to -directory)")
+	var options outputOptions
+	options.RegisterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s render [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if outputDirectory == "" {
+		outputDirectory = directory
+	}
+	return renderArchive(directory, outputDirectory, options, out)
+}
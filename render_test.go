@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var renderTestDir = filepath.Join("tmp", "render")
+
+func TestRenderArchive(t *testing.T) {
+	defer cleanupTestTmpDir(renderTestDir)
+	archiveDir := filepath.Join(renderTestDir, "archive")
+	outputDir := filepath.Join(renderTestDir, "markdown")
+
+	store := newBookmarkStore(archiveDir)
+	if err := store.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	bookmarks := []bookmarkData{
+		{
+			Bookmark: &instapaper.Bookmark{
+				Hash:     "hash1234",
+				ID:       1234,
+				Title:    "Stored bookmark",
+				URL:      "https://example.com/bookmark1234",
+				Time:     1288608076,
+				Starred:  "1",
+				Progress: 0.5,
+			},
+			FullText:         "<p>Stored <em>text</em>.</p>",
+			Highlights:       []instapaper.Highlight{{ID: 1, BookmarkID: 1234, Text: "Stored", Note: "A note"}},
+			ContainingFolder: "Unread",
+		},
+		{
+			BookmarkExportMeta: &bookmarkExportMeta{
+				URL:       "https://example.com/from-csv",
+				Title:     "From the CSV",
+				Timestamp: "1288608076",
+			},
+			ContainingFolder: "Unread",
+		},
+	}
+	for _, bookmark := range bookmarks {
+		if err := store.Save(bookmark); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := renderArchive(archiveDir, outputDir, outputOptions{Format: "markdown"}, &out); err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "rendered 2 bookmark(s)") {
+		t.Errorf("expected 2 bookmarks to be rendered, got %q", out.String())
+	}
+
+	goldenFileMatches(t, filepath.Join(outputDir, "2010-11-01-sha-aa511dbe28.md"), filepath.Join("testdata", "markdown", "2010-11-01-sha-aa511dbe28.md"))
+	fileContentsMatch(t, filepath.Join(outputDir, "2010-11-01-1234.md"), `---
+id: "1234"
+url: https://example.com/bookmark1234
+title: Stored bookmark
+folder: Unread
+saved: 2010-11-01
+progress: 0.5
+starred: true
+---
+
+# Stored bookmark
+
+Stored _text_.
+
+## Highlights
+
+> Stored
+
+> **Note:** A note
+`)
+}
+
+func TestRenderArchiveWithoutStore(t *testing.T) {
+	var out bytes.Buffer
+	if err := renderArchive(filepath.Join(renderTestDir, "missing"), renderTestDir, outputOptions{Format: "markdown"}, &out); err == nil {
+		t.Error("expected an error rendering an archive without a store")
+	}
+}
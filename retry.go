@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+// apiTimeout bounds each request to the Instapaper API.
+const apiTimeout = time.Minute
+
+// isTransientAPIError reports whether err is worth retrying: network errors,
+// server errors and rate limiting. Anything else the API returns, like
+// instapaper.ErrTextGen when it can't produce the text of a bookmark, will
+// fail the same way next time.
+func isTransientAPIError(err error) bool {
+	var apiErr *instapaper.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode {
+	case instapaper.ErrRateLimitExceeded, instapaper.ErrGeneric, instapaper.ErrHTTPError:
+		return true
+	}
+	return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+}
+
+// isPermanentAPIError reports whether err came from the API and won't go
+// away by retrying.
+func isPermanentAPIError(err error) bool {
+	var apiErr *instapaper.APIError
+	return errors.As(err, &apiErr) && !isTransientAPIError(err)
+}
+
+func isRateLimitError(err error) bool {
+	var apiErr *instapaper.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode == instapaper.ErrRateLimitExceeded || apiErr.StatusCode == http.StatusTooManyRequests
+}
+
+// apiTransport turns network errors and server errors into responses the
+// instapaper client can parse. The client assumes it always gets a response
+// with a JSON error body, and panics on network errors otherwise.
+type apiTransport struct {
+	Transport http.RoundTripper
+}
+
+func newAPIHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: apiTransport{Transport: http.DefaultTransport},
+		Timeout:   apiTimeout,
+	}
+}
+
+func (t apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return apiErrorResponse(req, http.StatusServiceUnavailable, err.Error()), nil
+	}
+	if res.StatusCode >= 500 {
+		res.Body.Close()
+		return apiErrorResponse(req, res.StatusCode, res.Status), nil
+	}
+	return res, nil
+}
+
+func apiErrorResponse(req *http.Request, statusCode int, message string) *http.Response {
+	body, _ := json.Marshal([]map[string]interface{}{{
+		"error_code": instapaper.ErrHTTPError,
+		"message":    message,
+	}})
+	return &http.Response{
+		Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var retryTestDir = filepath.Join("tmp", "retry")
+
+func newTestDownloadJob(api *instapaperAPI, bookmarkID int) *InstapaperBookmarkDownloadJob {
+	rateLimiter := newAPIRateLimiter(1000, 10)
+	rateLimiter.InitialBackoff = time.Millisecond
+	return &InstapaperBookmarkDownloadJob{
+		BookmarkData: &bookmarkData{Bookmark: &instapaper.Bookmark{ID: bookmarkID, URL: "https://example.com/bookmark"}},
+		Directory:    retryTestDir,
+		API:          api,
+		OutputWriter: jekyllOutputWriter{Directory: retryTestDir},
+		RateLimiter:  rateLimiter,
+	}
+}
+
+func TestInstapaperBookmarkDownloadJob_RetriesTransientErrors(t *testing.T) {
+	defer cleanupTestTmpDir(retryTestDir)
+	mux := newTestAPIHandler()
+	textRequests := 0
+	mux.HandleFunc("/bookmarks/get_text", func(w http.ResponseWriter, r *http.Request) {
+		textRequests++
+		if textRequests < 3 {
+			http.Error(w, "upstream unavailable", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "<p>full text</p>")
+	})
+	mux.HandleFunc("/bookmarks/1234/highlights", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[]")
+	})
+	client, server, err := newTestInstapaperClient(testEmailAddress, testPassword, mux)
+	defer server.Close()
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+
+	job := newTestDownloadJob(client, 1234)
+	if err := job.OutputWriter.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	if err := job.Process(context.Background()); err != nil {
+		t.Fatalf("expected job to succeed, got %v", err)
+	}
+	if textRequests != 3 {
+		t.Fatalf("expected 3 requests for the text, got %d", textRequests)
+	}
+	fileContentsMatch(t, filepath.Join(retryTestDir, "_mirror", "1234.html"), "<p>full text</p>")
+}
+
+func TestInstapaperBookmarkDownloadJob_RecordsPermanentErrors(t *testing.T) {
+	defer cleanupTestTmpDir(retryTestDir)
+	mux := newTestAPIHandler()
+	textRequests := 0
+	mux.HandleFunc("/bookmarks/get_text", func(w http.ResponseWriter, r *http.Request) {
+		textRequests++
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `[{"type":"error","error_code":1550,"message":"Error generating text version of this URL"}]`)
+	})
+	mux.HandleFunc("/bookmarks/1234/highlights", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[]")
+	})
+	client, server, err := newTestInstapaperClient(testEmailAddress, testPassword, mux)
+	defer server.Close()
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+
+	job := newTestDownloadJob(client, 1234)
+	if err := job.OutputWriter.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	if err := job.Process(context.Background()); err != nil {
+		t.Fatalf("expected job to succeed, got %v", err)
+	}
+	if textRequests != 1 {
+		t.Fatalf("expected 1 request for the text, got %d", textRequests)
+	}
+	fileContentsMatch(t, filepath.Join(retryTestDir, "_data", "1234.json"), `"text": "status 400: err #1550 - Error generating text version of this URL"`)
+}
+
+func TestInstapaperBookmarkDownloadJob_FailsAfterMaxAttempts(t *testing.T) {
+	defer cleanupTestTmpDir(retryTestDir)
+	mux := newTestAPIHandler()
+	textRequests := 0
+	mux.HandleFunc("/bookmarks/get_text", func(w http.ResponseWriter, r *http.Request) {
+		textRequests++
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/bookmarks/1234/highlights", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[]")
+	})
+	client, server, err := newTestInstapaperClient(testEmailAddress, testPassword, mux)
+	defer server.Close()
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+
+	job := newTestDownloadJob(client, 1234)
+	job.RateLimiter.MaxAttempts = 2
+	if err := job.OutputWriter.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	if err := job.Process(context.Background()); err == nil {
+		t.Fatalf("expected job to fail")
+	}
+	if textRequests != 2 {
+		t.Fatalf("expected 2 requests for the text, got %d", textRequests)
+	}
+	// The bookmark is still archived.
+	fileContentsMatch(t, filepath.Join(retryTestDir, "_data", "1234.json"), `"bookmark_id": 1234`)
+}
+
+func TestAPITransport_NetworkErrors(t *testing.T) {
+	client, server, err := newTestInstapaperClient(testEmailAddress, testPassword, newTestAPIHandler())
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	server.Close()
+
+	_, err = client.GetText(1234)
+	if !isTransientAPIError(err) {
+		t.Fatalf("expected a transient error, got %v", err)
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Errorf("expected the default HTTP client to be left alone")
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// searchIndexFileName is the file in the archive directory which holds the
+// search index between runs.
+const searchIndexFileName = ".search-index.json"
+
+// Terms found in these fields count this many times over terms in the full
+// text.
+const (
+	searchTitleWeight     = 5
+	searchURLWeight       = 2
+	searchHighlightWeight = 2
+	searchTextWeight      = 1
+)
+
+// Okapi BM25 tuning parameters.
+const (
+	searchK1 = 1.2
+	searchB  = 0.75
+)
+
+// searchIndex is an inverted index over the titles, URLs, folders,
+// highlights and full text of an archive's bookmarks. They're read from the
+// archive's store, which is kept whatever the format, or in archives from
+// before there was a store, from a Jekyll archive's _data/<id>.json,
+// _data/<id>.highlights.json and _mirror/<id>.html.
+type searchIndex struct {
+	Documents map[string]*searchDocument
+	// Postings maps each term to the weighted number of times it appears in
+	// each document, keyed by bookmark ID.
+	Postings map[string]map[string]int
+
+	directory string
+	dirty     bool
+	// fromStore is whether bookmarks are read from the store.
+	fromStore bool
+}
+
+type searchDocument struct {
+	ID     string
+	Title  string
+	URL    string
+	Folder string
+	Date   string
+	Length int
+	Terms  []string
+	// Sources records the size and modification time of each file the
+	// document was built from, so it's only reindexed when they change.
+	Sources map[string]string
+}
+
+type searchQuery struct {
+	Terms  []string
+	Folder string
+	After  string
+	Before string
+	Limit  int
+}
+
+type searchResult struct {
+	Document *searchDocument
+	Score    float64
+	Snippet  string
+}
+
+func loadSearchIndex(directory string) (*searchIndex, error) {
+	index := &searchIndex{
+		Documents: map[string]*searchDocument{},
+		Postings:  map[string]map[string]int{},
+		directory: directory,
+	}
+	path := filepath.Join(directory, searchIndexFileName)
+	if !fileExists(path) {
+		return index, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("unable to read search index %q: %v", path, err)
+	}
+	return index, nil
+}
+
+// Save writes the index back to the archive if it changed.
+func (idx *searchIndex) Save() error {
+	if !idx.dirty {
+		return nil
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(idx.directory, searchIndexFileName), data, 0644); err != nil {
+		return err
+	}
+	idx.dirty = false
+	return nil
+}
+
+// Update brings the index up to date with the archive, reindexing only the
+// bookmarks whose files have changed since they were last indexed.
+func (idx *searchIndex) Update() (updated, removed int, err error) {
+	sourceDir := filepath.Join(idx.directory, bookmarkStoreDirName)
+	idx.fromStore = fileExists(sourceDir)
+	if !idx.fromStore {
+		sourceDir = filepath.Join(idx.directory, "_data")
+	}
+	paths, err := filepath.Glob(filepath.Join(sourceDir, "*.json"))
+	if err != nil {
+		return 0, 0, err
+	}
+	present := map[string]bool{}
+	for _, path := range paths {
+		if strings.HasPrefix(filepath.Base(path), ".") || strings.HasSuffix(path, ".highlights.json") {
+			continue
+		}
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		present[id] = true
+
+		sources := idx.sources(id)
+		if doc, ok := idx.Documents[id]; ok && sameSearchSources(doc.Sources, sources) {
+			continue
+		}
+		if err := idx.reindex(id, sources); err != nil {
+			return updated, removed, fmt.Errorf("[%s] unable to index: %v", id, err)
+		}
+		updated++
+	}
+	for id := range idx.Documents {
+		if !present[id] {
+			idx.remove(id)
+			removed++
+		}
+	}
+	return updated, removed, nil
+}
+
+func (idx *searchIndex) sourcePaths(id string) map[string]string {
+	if idx.fromStore {
+		return map[string]string{"store": filepath.Join(idx.directory, bookmarkStoreDirName, id+".json")}
+	}
+	return map[string]string{
+		"data":       filepath.Join(idx.directory, "_data", id+".json"),
+		"highlights": filepath.Join(idx.directory, "_data", id+".highlights.json"),
+		"text":       filepath.Join(idx.directory, "_mirror", id+".html"),
+	}
+}
+
+func (idx *searchIndex) sources(id string) map[string]string {
+	sources := map[string]string{}
+	for name, path := range idx.sourcePaths(id) {
+		if info, err := os.Stat(path); err == nil {
+			sources[name] = fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return sources
+}
+
+func sameSearchSources(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *searchIndex) reindex(id string, sources map[string]string) error {
+	bookmark, err := idx.readBookmark(id, sources)
+	if err != nil {
+		return err
+	}
+	text, err := htmlToText(bookmark.FullText)
+	if err != nil {
+		return err
+	}
+
+	frequencies := map[string]int{}
+	addTerms := func(s string, weight int) {
+		for _, term := range searchTerms(s) {
+			frequencies[term] += weight
+		}
+	}
+	addTerms(bookmark.GetTitle(), searchTitleWeight)
+	addTerms(bookmark.GetURL(), searchURLWeight)
+	addTerms(text, searchTextWeight)
+	for _, highlight := range bookmark.Highlights {
+		addTerms(highlight.Text, searchHighlightWeight)
+		addTerms(highlight.Note, searchHighlightWeight)
+	}
+
+	idx.remove(id)
+	doc := &searchDocument{
+		ID:      id,
+		Title:   bookmark.GetTitle(),
+		URL:     bookmark.GetURL(),
+		Folder:  bookmark.ContainingFolder,
+		Date:    bookmark.GetYYYYMMDD(),
+		Sources: sources,
+	}
+	for term, frequency := range frequencies {
+		doc.Terms = append(doc.Terms, term)
+		doc.Length += frequency
+		if idx.Postings[term] == nil {
+			idx.Postings[term] = map[string]int{}
+		}
+		idx.Postings[term][id] = frequency
+	}
+	sort.Strings(doc.Terms)
+	idx.Documents[id] = doc
+	idx.dirty = true
+	return nil
+}
+
+// readBookmark reads what's indexed for the bookmark from its sources.
+func (idx *searchIndex) readBookmark(id string, sources map[string]string) (bookmarkData, error) {
+	paths := idx.sourcePaths(id)
+	var bookmark bookmarkData
+	if idx.fromStore {
+		data, err := ioutil.ReadFile(paths["store"])
+		if err != nil {
+			return bookmark, err
+		}
+		var stored storedBookmark
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return bookmark, err
+		}
+		return stored.bookmarkData(), nil
+	}
+	data, err := ioutil.ReadFile(paths["data"])
+	if err != nil {
+		return bookmark, err
+	}
+	if err := json.Unmarshal(data, &bookmark); err != nil {
+		return bookmark, err
+	}
+	if _, ok := sources["highlights"]; ok {
+		data, err := ioutil.ReadFile(paths["highlights"])
+		if err != nil {
+			return bookmark, err
+		}
+		if err := json.Unmarshal(data, &bookmark.Highlights); err != nil {
+			return bookmark, err
+		}
+	}
+	if _, ok := sources["text"]; ok {
+		data, err := ioutil.ReadFile(paths["text"])
+		if err != nil {
+			return bookmark, err
+		}
+		bookmark.FullText = string(data)
+	}
+	return bookmark, nil
+}
+
+func (idx *searchIndex) remove(id string) {
+	doc, ok := idx.Documents[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.Terms {
+		delete(idx.Postings[term], id)
+		if len(idx.Postings[term]) == 0 {
+			delete(idx.Postings, term)
+		}
+	}
+	delete(idx.Documents, id)
+	idx.dirty = true
+}
+
+// Search returns the documents containing every query term which match the
+// filters, best match first.
+func (idx *searchIndex) Search(query searchQuery) []searchResult {
+	if len(query.Terms) == 0 || len(idx.Documents) == 0 {
+		return nil
+	}
+	totalLength := 0
+	for _, doc := range idx.Documents {
+		totalLength += doc.Length
+	}
+	averageLength := float64(totalLength) / float64(len(idx.Documents))
+
+	scores := map[string]float64{}
+	for i, term := range query.Terms {
+		postings := idx.Postings[term]
+		idf := math.Log(1 + (float64(len(idx.Documents))-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		matched := map[string]float64{}
+		for id, frequency := range postings {
+			if _, ok := scores[id]; i > 0 && !ok {
+				continue
+			}
+			tf := float64(frequency)
+			length := float64(idx.Documents[id].Length)
+			matched[id] = scores[id] + idf*tf*(searchK1+1)/(tf+searchK1*(1-searchB+searchB*length/averageLength))
+		}
+		scores = matched
+	}
+
+	var results []searchResult
+	for id, score := range scores {
+		doc := idx.Documents[id]
+		if query.Folder != "" && !strings.EqualFold(doc.Folder, query.Folder) {
+			continue
+		}
+		if query.After != "" && doc.Date < query.After {
+			continue
+		}
+		if query.Before != "" && doc.Date > query.Before {
+			continue
+		}
+		results = append(results, searchResult{Document: doc, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Document.Date > results[j].Document.Date
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	for i := range results {
+		results[i].Snippet = idx.snippet(results[i].Document, query.Terms)
+	}
+	return results
+}
+
+// snippet returns the text surrounding the first query term found in the
+// document's full text, or failing that, its highlights.
+func (idx *searchIndex) snippet(doc *searchDocument, terms []string) string {
+	const radius = 80
+	bookmark, err := idx.readBookmark(doc.ID, idx.sources(doc.ID))
+	if err != nil {
+		return ""
+	}
+	var candidates []string
+	if text, err := htmlToText(bookmark.FullText); err == nil {
+		candidates = append(candidates, text)
+	}
+	for _, highlight := range bookmark.Highlights {
+		candidates = append(candidates, highlight.Text+" "+highlight.Note)
+	}
+	for _, text := range candidates {
+		lower := strings.ToLower(text)
+		if len(lower) != len(text) {
+			// Offsets into lower must line up with text.
+			lower = text
+		}
+		for _, term := range terms {
+			offset := strings.Index(lower, term)
+			if offset < 0 {
+				continue
+			}
+			start, end := offset-radius, offset+len(term)+radius
+			if start < 0 {
+				start = 0
+			}
+			if end > len(text) {
+				end = len(text)
+			}
+			for start > 0 && !utf8.RuneStart(text[start]) {
+				start--
+			}
+			for end < len(text) && !utf8.RuneStart(text[end]) {
+				end++
+			}
+			snippet := strings.TrimSpace(text[start:end])
+			if start > 0 {
+				snippet = "…" + snippet
+			}
+			if end < len(text) {
+				snippet += "…"
+			}
+			return snippet
+		}
+	}
+	return ""
+}
+
+// searchTerms splits s into lowercase words.
+func searchTerms(s string) []string {
+	var terms []string
+	for _, term := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(term)) > 1 {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// runSearch implements the search subcommand, which searches an existing
+// archive without talking to the API.
+func runSearch(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	var directory string
+	flags.StringVar(&directory, "directory", "archive", "The directory containing the archive")
+	var query searchQuery
+	flags.StringVar(&query.Folder, "folder", "", "Only show bookmarks in this folder")
+	flags.StringVar(&query.After, "after", "", "Only show bookmarks saved on or after this date (YYYY-MM-DD)")
+	flags.StringVar(&query.Before, "before", "", "Only show bookmarks saved on or before this date (YYYY-MM-DD)")
+	flags.IntVar(&query.Limit, "limit", 20, "Maximum number of results")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s search [flags] <query>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	query.Terms = searchTerms(strings.Join(flags.Args(), " "))
+	if len(query.Terms) == 0 {
+		flags.Usage()
+		return fmt.Errorf("must supply a query")
+	}
+	for _, date := range []struct{ flag, value string }{{"after", query.After}, {"before", query.Before}} {
+		if date.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date.value); err != nil {
+			flags.Usage()
+			return fmt.Errorf("-%s must be a date like 2020-01-31, got %q", date.flag, date.value)
+		}
+	}
+
+	index, err := loadSearchIndex(directory)
+	if err != nil {
+		return err
+	}
+	if _, _, err := index.Update(); err != nil {
+		return err
+	}
+	if err := index.Save(); err != nil {
+		return err
+	}
+
+	results := index.Search(query)
+	if len(results) == 0 {
+		fmt.Fprintln(out, "No results.")
+		return nil
+	}
+	for i, result := range results {
+		fmt.Fprintf(out, "%d. %s (%s, %s)\n", i+1, result.Document.Title, result.Document.Date, result.Document.Folder)
+		fmt.Fprintf(out, "   %s\n", result.Document.URL)
+		if result.Snippet != "" {
+			fmt.Fprintf(out, "   %s\n", result.Snippet)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var searchTestDir = filepath.Join("tmp", "search")
+
+func searchTestBookmarks() []bookmarkData {
+	return []bookmarkData{
+		{
+			Bookmark:         &instapaper.Bookmark{ID: 1, Title: "Gophers in the wild", URL: "https://example.com/gophers", Time: 1288608076},
+			FullText:         "<p>Field notes on the burrowing habits of pocket gophers.</p>",
+			ContainingFolder: "nature",
+		},
+		{
+			Bookmark:         &instapaper.Bookmark{ID: 2, Title: "Concurrency patterns", URL: "https://example.com/go", Time: 1600000000},
+			FullText:         "<p>Channels are how gophers communicate. <script>ignored()</script></p>",
+			ContainingFolder: "programming",
+			Highlights:       []instapaper.Highlight{{ID: 1, BookmarkID: 2, Text: "Share memory by communicating"}},
+		},
+		{
+			BookmarkExportMeta: &bookmarkExportMeta{URL: "https://example.com/csv", Title: "Only in the CSV", Timestamp: "1288608076"},
+			ContainingFolder:   "unread",
+		},
+	}
+}
+
+func writeSearchTestArchive(t *testing.T) {
+	w := jekyllOutputWriter{Directory: searchTestDir}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	for _, bookmark := range searchTestBookmarks() {
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	defer cleanupTestTmpDir(searchTestDir)
+	writeSearchTestArchive(t)
+
+	index, err := loadSearchIndex(searchTestDir)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if updated, _, err := index.Update(); err != nil || updated != 3 {
+		t.Fatalf("expected 3 documents to be indexed, got %d: %v", updated, err)
+	}
+
+	results := index.Search(searchQuery{Terms: searchTerms("Gophers")})
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0].Document.ID != "1" {
+		t.Errorf("expected the title match to rank first, got %q", results[0].Document.ID)
+	}
+	if !strings.Contains(results[0].Snippet, "pocket gophers") {
+		t.Errorf("expected snippet to contain the match, got %q", results[0].Snippet)
+	}
+
+	if results := index.Search(searchQuery{Terms: searchTerms("gophers channels")}); len(results) != 1 || results[0].Document.ID != "2" {
+		t.Errorf("expected only bookmark 2 to match every term, got %v", results)
+	}
+	if results := index.Search(searchQuery{Terms: searchTerms("communicating")}); len(results) != 1 || results[0].Snippet != "Share memory by communicating" {
+		t.Errorf("expected highlights to be searched, got %v", results)
+	}
+	if results := index.Search(searchQuery{Terms: searchTerms("ignored")}); len(results) != 0 {
+		t.Errorf("expected scripts not to be indexed, got %v", results)
+	}
+	if results := index.Search(searchQuery{Terms: searchTerms("gophers"), Folder: "Programming"}); len(results) != 1 || results[0].Document.ID != "2" {
+		t.Errorf("expected folder filter to apply, got %v", results)
+	}
+	if results := index.Search(searchQuery{Terms: searchTerms("gophers"), Before: "2010-12-31"}); len(results) != 1 || results[0].Document.ID != "1" {
+		t.Errorf("expected before filter to apply, got %v", results)
+	}
+	if results := index.Search(searchQuery{Terms: searchTerms("csv"), After: "2010-11-01"}); len(results) != 1 || results[0].Document.Title != "Only in the CSV" {
+		t.Errorf("expected after filter to apply, got %v", results)
+	}
+
+	// Only changed bookmarks are reindexed after a reload.
+	if err := index.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(searchTestDir, "_data", "2.json")); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(searchTestDir, "_mirror", "1.html"), []byte("<p>Now about marmots.</p>"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	index, err = loadSearchIndex(searchTestDir)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if updated, removed, err := index.Update(); err != nil || updated != 1 || removed != 1 {
+		t.Fatalf("expected 1 document updated and 1 removed, got %d and %d: %v", updated, removed, err)
+	}
+	if results := index.Search(searchQuery{Terms: searchTerms("marmots")}); len(results) != 1 {
+		t.Errorf("expected updated text to be indexed, got %v", results)
+	}
+	if results := index.Search(searchQuery{Terms: searchTerms("channels")}); len(results) != 0 {
+		t.Errorf("expected removed bookmark not to match, got %v", results)
+	}
+}
+
+func TestRunSearch(t *testing.T) {
+	defer cleanupTestTmpDir(searchTestDir)
+	writeSearchTestArchive(t)
+
+	var out bytes.Buffer
+	if err := runSearch([]string{"-directory", searchTestDir, "pocket"}, &out); err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	expected := "1. Gophers in the wild (2010-11-01, nature)\n   https://example.com/gophers\n   Field notes on the burrowing habits of pocket gophers.\n"
+	if out.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+	if !fileExists(filepath.Join(searchTestDir, searchIndexFileName)) {
+		t.Fatalf("expected search index to be saved")
+	}
+}
+
+// TestRunSearch_MultipleFormats searches an archive written in several
+// formats, where the Jekyll site is in a directory of its own.
+func TestRunSearch_MultipleFormats(t *testing.T) {
+	defer cleanupTestTmpDir(searchTestDir)
+	store := newBookmarkStore(searchTestDir)
+	if err := store.Preflight(); err != nil {
+		t.Fatalf("store preflight failed: %v", err)
+	}
+	w, err := newOutputWriter(searchTestDir, searchTestDir, outputOptions{Format: "markdown,jekyll", JekyllPostExtension: "html"}, nil)
+	if err != nil {
+		t.Fatalf("unable to create writer: %v", err)
+	}
+	if err := w.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	for _, bookmark := range searchTestBookmarks() {
+		if err := store.Save(bookmark); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+		if err := w.Write(bookmark); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := runSearch([]string{"-directory", searchTestDir, "communicating"}, &out); err != nil {
+		t.Fatalf("search failed: %v", err)
+	}
+	expected := "1. Concurrency patterns (2020-09-13, programming)\n   https://example.com/go\n   Share memory by communicating\n"
+	if out.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestRunSearch_InvalidDates(t *testing.T) {
+	defer cleanupTestTmpDir(searchTestDir)
+	writeSearchTestArchive(t)
+
+	for _, args := range [][]string{
+		{"-after", "2024-1-5"},
+		{"-before", "01/05/2024"},
+		{"-after", "2024-02-30"},
+	} {
+		var out bytes.Buffer
+		args = append([]string{"-directory", searchTestDir}, append(args, "gophers")...)
+		err := runSearch(args, &out)
+		if err == nil || !strings.Contains(err.Error(), "must be a date like 2020-01-31") {
+			t.Errorf("expected a date error for %v, got %v", args, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("expected no results for %v, got %q", args, out.String())
+		}
+	}
+}
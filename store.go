@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+// bookmarkStoreDirName is the directory in the archive which holds
+// everything fetched for each bookmark, so any output format can be
+// regenerated from it without the API.
+const bookmarkStoreDirName = ".store"
+
+// storedBookmark is how a bookmark is kept in the store. Unlike the JSON
+// written for Jekyll, it includes the full text and highlights.
+type storedBookmark struct {
+	Bookmark           *instapaper.Bookmark
+	BookmarkExportMeta *bookmarkExportMeta
+	ContainingFolder   string
+	FetchErrors        map[string]string `json:",omitempty"`
+	FullText           string
+	TextSource         string            `json:",omitempty"`
+	Assets             map[string]string `json:",omitempty"`
+	Highlights         []instapaper.Highlight
+}
+
+func (s storedBookmark) bookmarkData() bookmarkData {
+	return bookmarkData{
+		Bookmark:           s.Bookmark,
+		BookmarkExportMeta: s.BookmarkExportMeta,
+		ContainingFolder:   s.ContainingFolder,
+		FetchErrors:        s.FetchErrors,
+		FullText:           s.FullText,
+		TextSource:         s.TextSource,
+		Assets:             s.Assets,
+		Highlights:         s.Highlights,
+		TextFetched:        true,
+		HighlightsFetched:  true,
+	}
+}
+
+// merge fills in what wasn't fetched for bookmark from prev, an earlier copy
+// of it. prev may be stored under another ID: the same bookmark from an
+// export, or from the API, which then provides the Instapaper bookmark.
+func (s *storedBookmark) merge(prev storedBookmark, bookmark bookmarkData) {
+	if s.Bookmark == nil && prev.Bookmark != nil {
+		s.Bookmark = prev.Bookmark
+		s.ContainingFolder = prev.ContainingFolder
+	}
+	if s.BookmarkExportMeta == nil {
+		s.BookmarkExportMeta = prev.BookmarkExportMeta
+	}
+	if !bookmark.TextFetched && len(s.FullText) == 0 {
+		s.FullText = prev.FullText
+		s.TextSource = prev.TextSource
+		s.Assets = prev.Assets
+	}
+	// Images mirrored before still apply if the text is the same.
+	if s.Assets == nil && s.FullText == prev.FullText {
+		s.Assets = prev.Assets
+	}
+	if !bookmark.HighlightsFetched && len(s.Highlights) == 0 {
+		s.Highlights = prev.Highlights
+	}
+}
+
+// bookmarkStore keeps one JSON file per bookmark. A nil store ignores
+// everything.
+type bookmarkStore struct {
+	Directory string
+
+	// Bookmarks are merged with what's stored, so saving one must not race
+	// with another save of it.
+	mu sync.Mutex
+	// ids maps the URL of each stored bookmark to its ID, so a bookmark
+	// from an export and the same one from the API are stored once. It's
+	// read from the store when first needed.
+	ids map[string]string
+}
+
+func newBookmarkStore(archiveDirectory string) *bookmarkStore {
+	return &bookmarkStore{Directory: filepath.Join(archiveDirectory, bookmarkStoreDirName)}
+}
+
+func (s *bookmarkStore) Preflight() error {
+	if s == nil {
+		return nil
+	}
+	if err := os.MkdirAll(s.Directory, 0755); err != nil {
+		return err
+	}
+	return removeAtomicWriteTempFiles(s.Directory)
+}
+
+func (s *bookmarkStore) path(id string) string {
+	return filepath.Join(s.Directory, id+".json")
+}
+
+// Save stores the bookmark. Full text or highlights which weren't fetched
+// this time are kept from what was stored before. A bookmark stored under
+// another ID with the same URL, i.e. from an export as well as the API, is
+// merged into it and stored under the API's ID.
+func (s *bookmarkStore) Save(bookmark bookmarkData) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadIDs(); err != nil {
+		return err
+	}
+
+	stored := storedBookmark{
+		Bookmark:           bookmark.Bookmark,
+		BookmarkExportMeta: bookmark.BookmarkExportMeta,
+		ContainingFolder:   bookmark.ContainingFolder,
+		FetchErrors:        bookmark.FetchErrors,
+		FullText:           bookmark.FullText,
+		TextSource:         bookmark.TextSource,
+		Assets:             bookmark.Assets,
+		Highlights:         bookmark.Highlights,
+	}
+	ids := []string{bookmark.GetID()}
+	if id, ok := s.ids[bookmark.GetURL()]; ok && id != ids[0] {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		prev, ok, err := s.load(s.path(id))
+		if err != nil {
+			return err
+		}
+		if ok {
+			stored.merge(prev, bookmark)
+		}
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	merged := stored.bookmarkData()
+	if err := writeFileAtomic(s.path(merged.GetID()), data, 0644); err != nil {
+		return err
+	}
+	s.ids[bookmark.GetURL()] = merged.GetID()
+	for _, id := range ids {
+		if id == merged.GetID() {
+			continue
+		}
+		if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIDs reads the URL and ID of every stored bookmark, once.
+func (s *bookmarkStore) loadIDs() error {
+	if s.ids != nil {
+		return nil
+	}
+	ids := map[string]string{}
+	err := s.each(func(stored storedBookmark) error {
+		bookmark := stored.bookmarkData()
+		// Prefer the API's ID if both are stored.
+		if _, ok := ids[bookmark.GetURL()]; !ok || bookmark.Bookmark != nil {
+			ids[bookmark.GetURL()] = bookmark.GetID()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.ids = ids
+	return nil
+}
+
+// HasFullText reports whether full text has been stored for the bookmark
+// with the given ID.
+func (s *bookmarkStore) HasFullText(id string) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok, err := s.load(s.path(id))
+	if err != nil {
+		return false, err
+	}
+	return ok && len(stored.FullText) > 0, nil
+}
+
+func (s *bookmarkStore) load(path string) (storedBookmark, bool, error) {
+	var stored storedBookmark
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return stored, false, nil
+	}
+	if err != nil {
+		return stored, false, err
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return stored, false, err
+	}
+	return stored, true, nil
+}
+
+// Each calls fn with every stored bookmark, in order of ID, stopping at the
+// first error.
+func (s *bookmarkStore) Each(fn func(bookmarkData) error) error {
+	if s == nil {
+		return nil
+	}
+	return s.each(func(stored storedBookmark) error {
+		return fn(stored.bookmarkData())
+	})
+}
+
+func (s *bookmarkStore) each(fn func(storedBookmark) error) error {
+	entries, err := ioutil.ReadDir(s.Directory)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		stored, _, err := s.load(filepath.Join(s.Directory, name))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		if err := fn(stored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ochronus/instapaper-go-client/instapaper"
+)
+
+var bookmarkStoreTestDir = filepath.Join("tmp", "bookmarkStore")
+
+func TestBookmarkStoreKeepsPreviousTextAndHighlights(t *testing.T) {
+	store := newBookmarkStore(bookmarkStoreTestDir)
+	if err := store.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(bookmarkStoreTestDir)
+
+	bookmark := bookmarkData{
+		Bookmark:         &instapaper.Bookmark{ID: 1234, Hash: "hash1234", URL: "https://example.com/1234", Title: "Title"},
+		FullText:         "<p>Full text</p>",
+		Assets:           map[string]string{"https://example.com/a.png": "aaaa.png"},
+		Highlights:       []instapaper.Highlight{{ID: 1, BookmarkID: 1234, Text: "Full", Time: "1288608076"}},
+		ContainingFolder: "Unread",
+	}
+	if err := store.Save(bookmark); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	// A later run moved it, but failed to fetch the text and highlights.
+	moved := bookmarkData{Bookmark: bookmark.Bookmark, ContainingFolder: "Archive"}
+	if err := store.Save(moved); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	var stored []bookmarkData
+	err := store.Each(func(bookmark bookmarkData) error {
+		stored = append(stored, bookmark)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("each failed: %v", err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("expected 1 stored bookmark, got %d", len(stored))
+	}
+	if stored[0].ContainingFolder != "Archive" {
+		t.Errorf("expected folder to be updated to Archive, got %q", stored[0].ContainingFolder)
+	}
+	if stored[0].FullText != bookmark.FullText {
+		t.Errorf("expected full text %q to be kept, got %q", bookmark.FullText, stored[0].FullText)
+	}
+	if !reflect.DeepEqual(stored[0].Assets, bookmark.Assets) {
+		t.Errorf("expected mirrored images %v to be kept, got %v", bookmark.Assets, stored[0].Assets)
+	}
+	if !reflect.DeepEqual(stored[0].Highlights, bookmark.Highlights) {
+		t.Errorf("expected highlights %+v to be kept, got %+v", bookmark.Highlights, stored[0].Highlights)
+	}
+}
+
+func TestBookmarkStoreRemovesDeletedHighlights(t *testing.T) {
+	store := newBookmarkStore(bookmarkStoreTestDir)
+	if err := store.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(bookmarkStoreTestDir)
+
+	bookmark := bookmarkData{
+		Bookmark:          &instapaper.Bookmark{ID: 1234, Hash: "hash1234", URL: "https://example.com/1234", Title: "Title"},
+		FullText:          "<p>Full text</p>",
+		Highlights:        []instapaper.Highlight{{ID: 1, BookmarkID: 1234, Text: "Full", Time: "1288608076"}},
+		TextFetched:       true,
+		HighlightsFetched: true,
+	}
+	if err := store.Save(bookmark); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	bookmark.Highlights = nil
+	if err := store.Save(bookmark); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	err := store.Each(func(stored bookmarkData) error {
+		if len(stored.Highlights) != 0 {
+			t.Errorf("expected the deleted highlights to be removed, got %+v", stored.Highlights)
+		}
+		if stored.FullText != bookmark.FullText {
+			t.Errorf("expected full text %q, got %q", bookmark.FullText, stored.FullText)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("each failed: %v", err)
+	}
+}
+
+func TestBookmarkStoreMergesExportAndAPIBookmarks(t *testing.T) {
+	store := newBookmarkStore(bookmarkStoreTestDir)
+	if err := store.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	defer cleanupTestTmpDir(bookmarkStoreTestDir)
+
+	// An earlier run only had the export, and captured the original page.
+	meta := &bookmarkExportMeta{URL: "https://example.com/1234", Title: "From the export", Selection: "A selection"}
+	exported := bookmarkData{BookmarkExportMeta: meta, FullText: "<p>Captured</p>", TextSource: textSourceOriginal, TextFetched: true}
+	if err := store.Save(exported); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	// Now the API has it too, but its text couldn't be fetched.
+	fromAPI := bookmarkData{
+		Bookmark:          &instapaper.Bookmark{ID: 1234, Hash: "hash1234", URL: "https://example.com/1234", Title: "Title"},
+		ContainingFolder:  "Unread",
+		HighlightsFetched: true,
+	}
+	if err := newBookmarkStore(bookmarkStoreTestDir).Save(fromAPI); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	// Saving the export again is merged into the API's bookmark as well.
+	store = newBookmarkStore(bookmarkStoreTestDir)
+	if err := store.Save(bookmarkData{BookmarkExportMeta: &bookmarkExportMeta{URL: meta.URL}, ContainingFolder: "Exported"}); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	var stored []bookmarkData
+	err := store.Each(func(bookmark bookmarkData) error {
+		stored = append(stored, bookmark)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("each failed: %v", err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("expected the bookmarks to be stored once, got %d", len(stored))
+	}
+	if stored[0].GetID() != "1234" || stored[0].ContainingFolder != "Unread" {
+		t.Errorf("expected the API's bookmark, got %s in %q", stored[0].GetID(), stored[0].ContainingFolder)
+	}
+	if stored[0].FullText != exported.FullText || stored[0].TextSource != textSourceOriginal {
+		t.Errorf("expected the captured text to be kept, got %q from %q", stored[0].FullText, stored[0].TextSource)
+	}
+	if stored[0].BookmarkExportMeta == nil {
+		t.Errorf("expected the export's metadata to be kept")
+	}
+}
@@ -6,12 +6,29 @@ package main
 // https://riptutorial.com/go/example/18325/job-queue-with-worker-pool
 
 import (
+	"context"
+	"fmt"
 	"sync"
 )
 
 // Job - interface for job processing
 type Job interface {
-	Process() error
+	ID() string
+	Process(ctx context.Context) error
+}
+
+// JobError - a failure returned by a job, keyed by the job's ID
+type JobError struct {
+	JobID string
+	Err   error
+}
+
+func (e JobError) Error() string {
+	return fmt.Sprintf("[%s] %v", e.JobID, e.Err)
+}
+
+func (e JobError) Unwrap() error {
+	return e.Err
 }
 
 // Worker - the worker threads that actually process the jobs
@@ -19,6 +36,7 @@ type Worker struct {
 	done             *sync.WaitGroup
 	readyPool        chan chan Job
 	assignedJobQueue chan Job
+	results          *jobResults
 
 	quit chan bool
 }
@@ -30,16 +48,39 @@ type JobQueue struct {
 	workers           []*Worker
 	dispatcherStopped *sync.WaitGroup
 	workersStopped    *sync.WaitGroup
+	results           *jobResults
 	quit              chan bool
 }
 
+// jobResults - tracks outstanding jobs and collects their failures
+type jobResults struct {
+	pending   sync.WaitGroup
+	mu        sync.Mutex
+	succeeded int
+	errors    []JobError
+	progress  *progressReporter
+}
+
+func (r *jobResults) record(job Job, err error) {
+	r.mu.Lock()
+	if err != nil {
+		r.errors = append(r.errors, JobError{JobID: job.ID(), Err: err})
+	} else {
+		r.succeeded++
+	}
+	r.mu.Unlock()
+	r.progress.JobFinished(err)
+	r.pending.Done()
+}
+
 // NewJobQueue - creates a new job queue
 func NewJobQueue(maxWorkers int) *JobQueue {
-	workersStopped := sync.WaitGroup{} // TODO: convert to error
+	workersStopped := sync.WaitGroup{}
+	results := &jobResults{}
 	readyPool := make(chan chan Job, maxWorkers)
 	workers := make([]*Worker, maxWorkers, maxWorkers)
 	for i := 0; i < maxWorkers; i++ {
-		workers[i] = NewWorker(readyPool, &workersStopped)
+		workers[i] = NewWorker(readyPool, &workersStopped, results)
 	}
 	return &JobQueue{
 		internalQueue:     make(chan Job),
@@ -47,15 +88,24 @@ func NewJobQueue(maxWorkers int) *JobQueue {
 		workers:           workers,
 		dispatcherStopped: &sync.WaitGroup{},
 		workersStopped:    &workersStopped,
+		results:           results,
 		quit:              make(chan bool),
 	}
 }
 
-// Start - starts the worker routines and dispatcher routine
-func (q *JobQueue) Start() {
+// ReportProgress - reports on jobs as they're submitted and processed. Must
+// be called before Start.
+func (q *JobQueue) ReportProgress(progress *progressReporter) {
+	q.results.progress = progress
+}
+
+// Start - starts the worker routines and dispatcher routine. Jobs are
+// processed with ctx, so cancelling it aborts in-flight jobs.
+func (q *JobQueue) Start(ctx context.Context) {
 	for i := 0; i < len(q.workers); i++ {
-		q.workers[i].Start()
+		q.workers[i].Start(ctx)
 	}
+	q.dispatcherStopped.Add(1)
 	go q.dispatch()
 }
 
@@ -66,7 +116,6 @@ func (q *JobQueue) Stop() {
 }
 
 func (q *JobQueue) dispatch() {
-	q.dispatcherStopped.Add(1)
 	for {
 		select {
 		case job := <-q.internalQueue: // We got something in on our queue
@@ -83,30 +132,60 @@ func (q *JobQueue) dispatch() {
 	}
 }
 
-// Submit - adds a new job to be processed
-func (q *JobQueue) Submit(job Job) {
-	q.internalQueue <- job
+// Submit - adds a new job to be processed, unless ctx is done first
+func (q *JobQueue) Submit(ctx context.Context, job Job) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	q.results.pending.Add(1)
+	select {
+	case q.internalQueue <- job:
+		q.results.progress.JobSubmitted()
+		return nil
+	case <-ctx.Done():
+		q.results.pending.Done()
+		return ctx.Err()
+	}
+}
+
+// Wait - blocks until every submitted job has been processed and returns the
+// failures, if any
+func (q *JobQueue) Wait() []JobError {
+	q.results.pending.Wait()
+	q.results.mu.Lock()
+	defer q.results.mu.Unlock()
+	return append([]JobError(nil), q.results.errors...)
+}
+
+// Succeeded - returns the number of jobs which have been processed without
+// error
+func (q *JobQueue) Succeeded() int {
+	q.results.mu.Lock()
+	defer q.results.mu.Unlock()
+	return q.results.succeeded
 }
 
 // NewWorker - creates a new worker
-func NewWorker(readyPool chan chan Job, done *sync.WaitGroup) *Worker {
+func NewWorker(readyPool chan chan Job, done *sync.WaitGroup, results *jobResults) *Worker {
 	return &Worker{
 		done:             done,
 		readyPool:        readyPool,
 		assignedJobQueue: make(chan Job),
+		results:          results,
 		quit:             make(chan bool),
 	}
 }
 
 // Start - begins the job processing loop for the worker
-func (w *Worker) Start() {
+func (w *Worker) Start(ctx context.Context) {
+	w.done.Add(1)
 	go func() {
-		w.done.Add(1)
 		for {
 			w.readyPool <- w.assignedJobQueue // check the job queue in
 			select {
 			case job := <-w.assignedJobQueue: // see if anything has been assigned to the queue
-				_ = job.Process() // TODO: propagate error into errgroup
+				w.results.progress.JobStarted()
+				w.results.record(job, job.Process(ctx))
 			case <-w.quit:
 				w.done.Done()
 				return
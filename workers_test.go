@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+type testJob struct {
+	id  string
+	err error
+}
+
+func (j testJob) ID() string {
+	return j.id
+}
+
+func (j testJob) Process(ctx context.Context) error {
+	return j.err
+}
+
+func TestJobQueue_Wait(t *testing.T) {
+	queue := NewJobQueue(3)
+	queue.Start(context.Background())
+	defer queue.Stop()
+
+	failure := errors.New("oops")
+	for i := 0; i < 10; i++ {
+		job := testJob{id: strconv.Itoa(i)}
+		if i%4 == 0 {
+			job.err = failure
+		}
+		if err := queue.Submit(context.Background(), job); err != nil {
+			t.Fatalf("submit failed: %v", err)
+		}
+	}
+
+	failures := queue.Wait()
+	if len(failures) != 3 {
+		t.Fatalf("expected 3 failures, got %d: %v", len(failures), failures)
+	}
+	ids := map[string]bool{}
+	for _, f := range failures {
+		if !errors.Is(f, failure) {
+			t.Errorf("expected failure to wrap %v, got %v", failure, f.Err)
+		}
+		ids[f.JobID] = true
+	}
+	for _, id := range []string{"0", "4", "8"} {
+		if !ids[id] {
+			t.Errorf("expected failure for job %q, got %v", id, failures)
+		}
+	}
+}
+
+type blockingJob struct {
+	started chan struct{}
+}
+
+func (j blockingJob) ID() string {
+	return "blocking"
+}
+
+func (j blockingJob) Process(ctx context.Context) error {
+	close(j.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestJobQueue_Cancellation(t *testing.T) {
+	jobCtx, abortJobs := context.WithCancel(context.Background())
+	queue := NewJobQueue(1)
+	queue.Start(jobCtx)
+	defer queue.Stop()
+
+	job := blockingJob{started: make(chan struct{})}
+	if err := queue.Submit(context.Background(), job); err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	<-job.started
+
+	submitCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := queue.Submit(submitCtx, testJob{id: "never"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected submit to be cancelled, got %v", err)
+	}
+
+	abortJobs()
+	failures := queue.Wait()
+	if len(failures) != 1 || !errors.Is(failures[0], context.Canceled) {
+		t.Fatalf("expected in-flight job to be aborted, got %v", failures)
+	}
+	if queue.Succeeded() != 0 {
+		t.Fatalf("expected no jobs to succeed, got %d", queue.Succeeded())
+	}
+}